@@ -4,17 +4,34 @@ package asyncfs
 
 import (
 	"os"
+	"syscall"
 )
 
-func openAsync(path string, flag int, perm os.FileMode) (*os.File, error) {
+// the vectored operations are gathered into one buffer
+const nativeVectored = false
+
+// sysPread and sysPwrite are the positional syscalls of rawPread and rawPwrite
+const (
+	sysPread  = syscall.SYS_PREAD
+	sysPwrite = syscall.SYS_PWRITE
+)
+
+type (
+	opCtx struct{}
+)
+
+func (c *ctx) openAsync(path string, flag int, perm os.FileMode) (*os.File, error) {
 	return os.OpenFile(path, flag, perm)
 }
 
 func (f *File) writeAsync(data []uint8) (int, error) {
 	f.mtx.Lock()
 	f.lastSyncSeek = true
-	n, err := f.asyncRWAio(OpWrite, data)
+	o := newOp(f, OpWrite, data, f.pos)
+	o.cursor = true
+	n, err := f.asyncRWAio(OpWrite, o)
 	if err == nil {
+		f.lastAsyncOpState.op = o
 		f.lastAsyncOpState.complete = false
 		f.lastAsyncOpState.lastOp = OpWrite
 	}
@@ -25,8 +42,11 @@ func (f *File) writeAsync(data []uint8) (int, error) {
 func (f *File) readAsync(data []uint8) (int, error) {
 	f.mtx.Lock()
 	f.lastSyncSeek = true
-	n, err := f.asyncRWAio(OpRead, data)
+	o := newOp(f, OpRead, data, f.pos)
+	o.cursor = true
+	n, err := f.asyncRWAio(OpRead, o)
 	if err == nil {
+		f.lastAsyncOpState.op = o
 		f.lastAsyncOpState.complete = false
 		f.lastAsyncOpState.lastOp = OpRead
 	}
@@ -34,8 +54,78 @@ func (f *File) readAsync(data []uint8) (int, error) {
 	return n, err
 }
 
+func (f *File) submit(o *Op) error {
+	switch o.kind {
+	case OpAllocate, OpTruncate, OpOpen, OpClose, OpStat:
+		// aio can't do them
+		if err := f.ctx.offload(o, func() (int64, error) {
+			return f.doSync(o)
+		}); err != nil {
+			return err
+		}
+		f.ctx.armTimers(o)
+		return nil
+	}
+	if _, err := f.asyncRWAio(uint16(o.kind), o); err != nil {
+		return err
+	}
+	f.ctx.armTimers(o)
+	return nil
+}
+
+// submitPath does the operation which isn't bound to a file on a goroutine
+func (c *ctx) submitPath(o *Op) error {
+	return c.offloadPath(o)
+}
+
+// submitBarrier fences the following submissions in userspace
+func (c *ctx) submitBarrier(o *Op) error {
+	return c.fence(o)
+}
+
+// submitChain emulates the linked operations, the next one is submitted when the previous one is completed.
+// It returns the number of the submitted operations, which is zero if it fails
+func (c *ctx) submitChain(ops []*Op, hard bool) (int, error) {
+	if err := c.submitLinked(ops, hard); err != nil {
+		return 0, err
+	}
+	return len(ops), nil
+}
+
+// submitBatch submits the operations one by one, the fsync can't be a part of lio_listio.
+// It returns the number of the submitted operations, the rest aren't submitted.
+func (c *ctx) submitBatch(ops []*Op) (int, error) {
+	for i, o := range ops {
+		if err := o.f.submit(o); err != nil {
+			return i, err
+		}
+	}
+	return len(ops), nil
+}
+
+// allocateSync extends the file, there is no portable fallocate with the modes
+func (f *File) allocateSync(off, length int64, mode uint32) error {
+	return f.extend(off, length, mode)
+}
+
 func (f *File) fillOpState() error {
-	return f.fillStateAio()
+	return f.ctx.fillOpStates()
+}
+
+// fillOpStates fills the states of the completed operations unless the context is being closed
+func (c *ctx) fillOpStates() error {
+	c.Lock()
+	closed := c.closed
+	c.Unlock()
+	if closed {
+		// the operations are drained by close
+		return nil
+	}
+	return fillStatesAio(c)
+}
+
+func (o *Op) poll() error {
+	return o.c.fillOpStates()
 }
 
 func (f *File) close() error {
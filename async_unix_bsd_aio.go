@@ -3,6 +3,7 @@
 package asyncfs
 
 //#include <aio.h>
+//#include <fcntl.h>
 //#include <stdlib.h>
 //#include <strings.h>
 //#include <sys/errno.h>
@@ -10,19 +11,33 @@ package asyncfs
 import "C"
 import (
 	"fmt"
-	"reflect"
+	"syscall"
+	"time"
 	"unsafe"
 )
 
+// aioSuspendMax bounds the aiocbs passed to aio_suspend, darwin takes at most AIO_LISTIO_MAX of them
+const aioSuspendMax = 16
+
 // https://github.com/freebsd/freebsd-src/blob/098dbd7ff7f3da9dda03802cdb2d8755f816eada/tests/sys/aio/aio_test.c#L260
-func (f *File) asyncRWAio(op uint16, data []uint8) (int, error) {
+func (f *File) asyncRWAio(op uint16, o *Op) (int, error) {
+	f.ctx.Lock()
+	closed := f.ctx.closed
+	f.ctx.Unlock()
+	if closed {
+		return 0, ErrCtxClosed
+	}
+
+	data := o.buf
 	var cb *C.struct_aiocb
 	cb = (*C.struct_aiocb)(C.malloc(C.size_t(C.sizeof_struct_aiocb)))
 	C.bzero(unsafe.Pointer(cb), C.size_t(C.sizeof_struct_aiocb))
-	cb.aio_buf = unsafe.Pointer(&data[0])
-	cb.aio_nbytes = C.size_t(len(data))
 	cb.aio_fildes = C.int(f.fd.Fd())
-	cb.aio_offset = C.off_t(f.pos)
+	if len(data) > 0 {
+		cb.aio_buf = unsafe.Pointer(&data[0])
+		cb.aio_nbytes = C.size_t(len(data))
+		cb.aio_offset = C.off_t(o.off)
+	}
 
 	var opRes C.int
 	switch op {
@@ -30,36 +45,113 @@ func (f *File) asyncRWAio(op uint16, data []uint8) (int, error) {
 		opRes = C.aio_read(cb)
 	case OpWrite:
 		opRes = C.aio_write(cb)
+	case OpSync:
+		opRes = C.aio_fsync(C.O_SYNC, cb)
+	case OpDatasync:
+		opRes = C.aio_fsync(C.O_DSYNC, cb)
+		if int(opRes) < 0 {
+			// O_DSYNC isn't supported by the older systems
+			opRes = C.aio_fsync(C.O_SYNC, cb)
+		}
 	default:
+		C.free(unsafe.Pointer(cb))
 		return 0, fmt.Errorf("undefined operation '%d'", op)
 	}
 
 	if int(opRes) < 0 {
+		C.free(unsafe.Pointer(cb))
 		return 0, ErrNotSubmittedAio
 	}
 
+	f.ctx.Lock()
+	f.ctx.operationsFd[unsafe.Pointer(cb)] = o
+	f.ctx.Unlock()
+
+	return 0, nil
+}
+
+func (c *ctx) cancel(o *Op) error {
 	c.Lock()
-	c.operationsFd[unsafe.Pointer(cb)] = opCap{
-		f:    f,
-		data: int64(cap(data)),
+	var cb unsafe.Pointer
+	for k, op := range c.operationsFd {
+		if op == o {
+			cb = k
+			break
+		}
+	}
+	if cb == nil {
+		c.Unlock()
+		if o.isDone() {
+			return nil
+		}
+		// the operation is offloaded to a goroutine
+		return ErrNotCancelled
 	}
+
+	// the lock is held, so the aiocb isn't freed by the reaping
+	// the cancelled operation is reaped by aio_error with ECANCELED
+	res := C.aio_cancel(C.int(o.f.fd.Fd()), (*C.struct_aiocb)(cb))
 	c.Unlock()
+	switch res {
+	case C.AIO_CANCELED, C.AIO_ALLDONE:
+		return nil
+	case C.AIO_NOTCANCELED:
+		return ErrNotCancelled
+	default:
+		return ErrAioError
+	}
+}
 
-	return 0, nil
+// suspendAio blocks in aio_suspend until one of the pending operations is completed or the timeout expires,
+// a negative timeout waits forever. At most aioSuspendMax operations are watched, the wait is bounded by waitSlice
+// if more of them are pending. The kernels look the aiocbs up by the address, so an aiocb freed by a concurrent reaping
+// isn't read by aio_suspend
+func suspendAio(c *ctx, timeout time.Duration) error {
+	c.Lock()
+	list := make([]*C.struct_aiocb, 0, aioSuspendMax)
+	for k := range c.operationsFd {
+		if len(list) == aioSuspendMax {
+			break
+		}
+		list = append(list, (*C.struct_aiocb)(k))
+	}
+	pending := len(c.operationsFd)
+	c.Unlock()
+	if len(list) == 0 {
+		return nil
+	}
+	if len(list) < pending && (timeout < 0 || timeout > waitSlice) {
+		timeout = waitSlice
+	}
+	var ts *C.struct_timespec
+	if timeout >= 0 {
+		ts = &C.struct_timespec{
+			tv_sec:  C.time_t(timeout / time.Second),
+			tv_nsec: C.long(timeout % time.Second),
+		}
+	}
+	res, err := C.aio_suspend(&list[0], C.int(len(list)), ts)
+	if int(res) < 0 && err != syscall.EAGAIN && err != syscall.EINTR {
+		return err
+	}
+	return nil
 }
 
-func (f *File) fillStateAio() error {
+func fillStatesAio(c *ctx) error {
 	c.Lock()
-	defer c.Unlock()
 
 	if len(c.operationsFd) == 0 {
+		c.Unlock()
 		return nil
 	}
 
-	for k, fd := range c.operationsFd {
+	var err error
+	var completed []*Op
+	for k, o := range c.operationsFd {
 		errState := C.aio_error((*C.struct_aiocb)(k))
 		if (int)(errState) == -1 {
-			return ErrAioError
+			err = ErrAioError
+			break
 		}
 		if errState == C.EINPROGRESS {
 			continue
@@ -69,27 +161,17 @@ func (f *File) fillStateAio() error {
 
 		aioResult := (int)(C.aio_return(cb))
 		if aioResult < 0 {
-			return ErrAioError
+			o.setResult(-int64(errState))
+		} else {
+			o.setResult(int64(aioResult))
 		}
-
-		fd.f.mtx.Lock()
-		if fd.f.lastAsyncOpState.lastOp == OpRead {
-			var b []uint8
-			sh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
-			sh.Data = uintptr(cb.aio_buf)
-			sh.Len = int(cb.aio_nbytes)
-			sh.Cap = int(fd.data)
-			fd.f.lastAsyncOpState.data = b
-			fd.f.lastAsyncOpState.eof = cb.aio_nbytes > 0 && aioResult == 0
-		}
-		fd.f.lastAsyncOpState.result = int64(aioResult)
-		fd.f.pos = int64(cb.aio_offset) + int64(aioResult)
-		fd.f.lastAsyncOpState.complete = true
-		fd.f.mtx.Unlock()
+		completed = append(completed, o)
 
 		C.free(k)
 		delete(c.operationsFd, k)
 	}
+	c.Unlock()
 
-	return nil
+	c.completeOps(completed)
+	return err
 }
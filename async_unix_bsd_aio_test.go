@@ -11,6 +11,12 @@ import (
 	"time"
 )
 
+func cursorOp(f *File, kind int, buf []uint8) *Op {
+	o := newOp(f, kind, buf, f.pos)
+	o.cursor = true
+	return o
+}
+
 func Test_bsd_asyncRWAio(t *testing.T) {
 	prepare(t, 0)
 
@@ -20,7 +26,7 @@ func Test_bsd_asyncRWAio(t *testing.T) {
 
 	buf := make([]uint8, 2000)
 	buf[0] = 'a'
-	n, err := f.asyncRWAio(OpWrite, buf)
+	n, err := f.asyncRWAio(OpWrite, cursorOp(f, OpWrite, buf))
 	assert.Equal(t, 0, n)
 	assert.NoError(t, err)
 	assert.NotEqual(t, 0, len(c.operationsFd))
@@ -38,7 +44,7 @@ func Test_bsd_asyncWrite(t *testing.T) {
 		buf[i] = uint8(i)
 	}
 
-	_, err = f.asyncRWAio(OpWrite, buf)
+	_, err = f.asyncRWAio(OpWrite, cursorOp(f, OpWrite, buf))
 	assert.NoError(t, err)
 
 	t1 := time.Now()
@@ -74,7 +80,7 @@ func Test_bsd_asyncRead(t *testing.T) {
 		buf[i] = uint8(i)
 	}
 
-	_, err = f.asyncRWAio(OpWrite, buf)
+	_, err = f.asyncRWAio(OpWrite, cursorOp(f, OpWrite, buf))
 	f.lastAsyncOpState.lastOp = OpWrite
 	f.lastAsyncOpState.complete = false
 	assert.NoError(t, err)
@@ -94,7 +100,7 @@ func Test_bsd_asyncRead(t *testing.T) {
 
 	buf = make([]uint8, 2000)
 	f.pos = 0
-	_, err = f.asyncRWAio(OpRead, buf)
+	_, err = f.asyncRWAio(OpRead, cursorOp(f, OpRead, buf))
 	assert.NoError(t, err)
 	f.lastAsyncOpState.complete = false
 	f.lastAsyncOpState.lastOp = OpRead
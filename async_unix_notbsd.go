@@ -3,41 +3,70 @@
 package asyncfs
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"syscall"
+	"time"
+	"unsafe"
 )
 
-func openAsync(path string, flag int, perm os.FileMode) (*os.File, error) {
+// the kernel does the vectored operations, readv/writev on io_uring and preadv/pwritev on aio
+const nativeVectored = true
+
+// sysPread and sysPwrite are the positional syscalls of rawPread and rawPwrite
+const (
+	sysPread  = syscall.SYS_PREAD64
+	sysPwrite = syscall.SYS_PWRITE64
+)
+
+type (
+	opCtx struct {
+		iovs []syscall.Iovec
+		cb   aiocb
+		// ts is the timeout of the linked IORING_OP_LINK_TIMEOUT
+		ts kernelTimespec
+		// link is IOSQE_IO_LINK or IOSQE_IO_HARDLINK if the next sqe depends on the operation
+		link uint8
+		// name and name2 are the paths read by the kernel, stx is filled by statx
+		name  *byte
+		name2 *byte
+		stx   statxBuf
+		// sp are the arguments of the internal splice
+		sp spliceArgs
+		// fixed is set from the submission to the completion if the sqe refers to a registered buffer,
+		// it is guarded by the ctx lock
+		fixed bool
+	}
+)
+
+func (c *ctx) openAsync(path string, flag int, perm os.FileMode) (*os.File, error) {
 	if c.asyncMode == asyncAio {
 		flag |= syscall.O_DIRECT
 	}
+	if c.iopoll {
+		fd, err := os.OpenFile(path, flag|syscall.O_DIRECT, perm)
+		if err == nil || !errors.Is(err, syscall.EINVAL) {
+			return fd, err
+		}
+		// the filesystem doesn't support O_DIRECT, the operations of the file are offloaded
+	}
 	return os.OpenFile(path, flag, perm)
 }
 
 func (f *File) writeAsync(data []uint8) (int, error) {
-	if c.busy() {
-		return 0, ErrCtxBusy
-	}
-
 	f.lastSyncSeek = true
 
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
 
-	var err error
-	switch c.asyncMode {
-	case asyncIoUring:
-		_, err = f.asyncWriteIoUring(data)
-	case asyncAio:
-		_, err = f.asyncWriteAio(data)
-	default:
-		return 0, fmt.Errorf("unknown async mode '%v'", c.asyncMode)
-	}
-	if err != nil {
+	o := newOp(f, OpWrite, data, f.pos)
+	o.cursor = true
+	if err := f.submit(o); err != nil {
 		return 0, err
 	}
 
+	f.lastAsyncOpState.op = o
 	f.lastAsyncOpState.complete = false
 	f.lastAsyncOpState.lastOp = OpWrite
 
@@ -45,35 +74,256 @@ func (f *File) writeAsync(data []uint8) (int, error) {
 }
 
 func (f *File) readAsync(data []uint8) (int, error) {
-	if c.busy() {
-		return 0, ErrCtxBusy
-	}
-
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
 
 	f.lastSyncSeek = true
 
+	o := newOp(f, OpRead, data, f.pos)
+	o.cursor = true
+	if err := f.submit(o); err != nil {
+		return 0, err
+	}
+
+	f.lastAsyncOpState.op = o
+	f.lastAsyncOpState.complete = false
+	f.lastAsyncOpState.lastOp = OpRead
+
+	return 0, nil
+}
+
+// iovecs fills the iovecs of the operation skipping the empty buffers
+func (o *Op) iovecs() []syscall.Iovec {
+	o.iovs = o.iovs[:0]
+	for _, b := range o.Buffers() {
+		if len(b) > 0 {
+			o.iovs = append(o.iovs, newIovec(&b[0], len(b)))
+		}
+	}
+	return o.iovs
+}
+
+func (f *File) submit(o *Op) error {
+	if f.ctx.busy() {
+		return ErrCtxBusy
+	}
+
 	var err error
+	switch f.ctx.asyncMode {
+	case asyncIoUring:
+		if f.ctx.iopoll {
+			return f.submitPolled(o)
+		}
+		switch o.kind {
+		case OpRead:
+			_, err = f.asyncReadIoUring(o)
+		case OpWrite:
+			_, err = f.asyncWriteIoUring(o)
+		case OpSync, OpDatasync:
+			err = f.asyncFsyncIoUring(o)
+		case OpAllocate:
+			err = f.submitOrOffload(ioringOpFallocate, o)
+		case OpTruncate:
+			err = f.submitOrOffload(ioringOpFtruncate, o)
+		case OpOpen:
+			err = f.submitOrOffload(ioringOpOpenat, o)
+		case OpStat:
+			err = f.submitOrOffload(ioringOpStatx, o)
+		case OpClose:
+			// the descriptor is owned by os.File, so it is closed by it and not by IORING_OP_CLOSE
+			err = f.ctx.offloadSync(o)
+		default:
+			err = ErrUnknownOperation
+		}
+	case asyncAio:
+		switch o.kind {
+		case OpRead:
+			_, err = f.asyncReadAio(o)
+		case OpWrite:
+			_, err = f.asyncWriteAio(o)
+		case OpSync, OpDatasync:
+			err = f.asyncFsyncAio(o)
+		case OpAllocate, OpTruncate, OpOpen, OpClose, OpStat:
+			// aio can't do them
+			err = f.ctx.offloadSync(o)
+		default:
+			err = ErrUnknownOperation
+		}
+		if err == nil {
+			f.ctx.armTimers(o)
+		}
+	default:
+		err = fmt.Errorf("unknown async mode '%v'", f.ctx.asyncMode)
+	}
+	return err
+}
+
+// submitBatch submits the operations with one io_uring_enter or io_submit.
+// It returns the number of the submitted operations, the rest aren't submitted.
+func (c *ctx) submitBatch(ops []*Op) (int, error) {
 	switch c.asyncMode {
 	case asyncIoUring:
-		_, err = f.asyncReadIoUring(data)
+		if c.iopoll {
+			// the polled ring can't do everything, so the operations are submitted one by one
+			for i, o := range ops {
+				if err := o.f.submit(o); err != nil {
+					return i, err
+				}
+			}
+			return len(ops), nil
+		}
+		c.Lock()
+		busy := c.currentCnt+len(ops) > c.sz
+		c.Unlock()
+		if busy {
+			return 0, ErrCtxBusy
+		}
+		return c.submitIoUringN(ops, prepIoUring)
 	case asyncAio:
-		_, err = f.asyncReadAio(data)
+		for _, o := range ops {
+			var err error
+			switch o.kind {
+			case OpRead:
+				err = o.f.prepRWAio(iocbCmdPread, o)
+			case OpWrite:
+				err = o.f.prepRWAio(iocbCmdPwrite, o)
+			case OpSync, OpDatasync:
+				o.f.prepFsyncAio(o)
+			default:
+				err = ErrUnknownOperation
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		n, err := c.submitAio(ops...)
+		c.armTimers(ops[:n]...)
+		return n, err
 	default:
 		return 0, fmt.Errorf("unknown async mode '%v'", c.asyncMode)
 	}
-	if err != nil {
-		return 0, err
+}
+
+// submitChain submits the linked operations, io_uring runs them in order.
+// The polled ring can't do fsync, so the chain is emulated like on aio.
+// It returns the number of the submitted operations, the rest aren't submitted.
+func (c *ctx) submitChain(ops []*Op, hard bool) (int, error) {
+	linked := func() (int, error) {
+		if err := c.submitLinked(ops, hard); err != nil {
+			return 0, err
+		}
+		return len(ops), nil
+	}
+	if c.asyncMode != asyncIoUring || c.iopoll {
+		return linked()
 	}
+	c.Lock()
+	busy := c.currentCnt+len(ops) > c.sz
+	c.Unlock()
+	if busy {
+		return 0, ErrCtxBusy
+	}
+	for _, o := range ops {
+		if op, ok := pathOpcodes[o.kind]; ok && !c.supports(op) {
+			// the kernel can't do the operation on the path, so it is offloaded from the emulated chain
+			return linked()
+		}
+		if err := o.setNames(); err != nil {
+			return 0, err
+		}
+	}
+	link := uint8(ioringSqeIoLink)
+	if hard {
+		link = ioringSqeIoHardlink
+	}
+	for _, o := range ops[:len(ops)-1] {
+		o.link = link
+	}
+	return c.submitIoUringN(ops, prepIoUring)
+}
 
-	f.lastAsyncOpState.complete = false
-	f.lastAsyncOpState.lastOp = OpRead
+// submitPath submits the operation which isn't bound to a file, aio and the polled ring offload it
+func (c *ctx) submitPath(o *Op) error {
+	if c.busy() {
+		return ErrCtxBusy
+	}
+	if c.asyncMode != asyncIoUring || c.iopoll {
+		return c.offloadPath(o)
+	}
+	return c.submitPathIoUring(o)
+}
 
-	return 0, nil
+// submitBarrier drains the ring with IOSQE_IO_DRAIN, the offloaded operations submitted after it are deferred until it is completed.
+// aio and the polled ring fence the following submissions in userspace
+func (c *ctx) submitBarrier(o *Op) error {
+	if c.asyncMode != asyncIoUring || c.iopoll {
+		return c.fence(o)
+	}
+	c.Lock()
+	if len(c.offloading) > 0 || c.fenceOp != nil {
+		// the ring can't wait for the goroutines and the held submissions
+		c.Unlock()
+		return c.fence(o)
+	}
+	o.drain = true
+	c.drains++
+	c.Unlock()
+	if err := c.submitIoUring([]*Op{o}, prepIoUring); err != nil {
+		c.Lock()
+		o.drain = false
+		c.drains--
+		deferred := c.undefer()
+		c.Unlock()
+		for _, start := range deferred {
+			start()
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *ctx) cancel(o *Op) error {
+	switch c.asyncMode {
+	case asyncIoUring:
+		c.Lock()
+		_, pending := c.operationsFd[unsafe.Pointer(o)]
+		c.Unlock()
+		if !pending || c.iopoll {
+			// the polled operations can't be cancelled
+			if o.isDone() {
+				return nil
+			}
+			return ErrNotCancelled
+		}
+		return c.cancelIoUring(o)
+	case asyncAio:
+		return c.cancelAio(o)
+	default:
+		return fmt.Errorf("unknown async mode '%v'", c.asyncMode)
+	}
+}
+
+func (f *File) allocateSync(off, length int64, mode uint32) error {
+	return syscall.Fallocate(int(f.fd.Fd()), mode, off, length)
 }
 
 func (f *File) fillOpState() error {
+	return f.ctx.fillOpStates()
+}
+
+// fillOpStates fills the states of the completed operations unless the context is being closed
+func (c *ctx) fillOpStates() error {
+	c.Lock()
+	closed := c.closed
+	c.Unlock()
+	if closed {
+		// the operations are drained by close
+		return nil
+	}
+	return c.fillStates()
+}
+
+func (c *ctx) fillStates() error {
 	var err error
 	switch c.asyncMode {
 	case asyncIoUring:
@@ -86,11 +336,46 @@ func (f *File) fillOpState() error {
 	return err
 }
 
-func (f *File) close() error {
+// wait waits in the kernel for at least min completions and fills the states
+func (c *ctx) wait(min int, timeout time.Duration) error {
 	switch c.asyncMode {
-	case asyncIoUring, asyncAio:
-		return f.fd.Close()
+	case asyncIoUring:
+		return c.waitIoUring(min, timeout)
+	case asyncAio:
+		c.Lock()
+		closed := c.aio == 0
+		c.Unlock()
+		if closed {
+			return ErrCtxClosed
+		}
+		var ts *syscall.Timespec
+		if timeout >= 0 {
+			t := syscall.NsecToTimespec(int64(timeout))
+			ts = &t
+		}
+		err := waitStatesAio(c, min, ts)
+		if err == syscall.EINTR {
+			return nil
+		}
+		return err
 	default:
 		return fmt.Errorf("unknown async mode '%v'", c.asyncMode)
 	}
 }
+
+func (o *Op) poll() error {
+	return o.c.fillOpStates()
+}
+
+func (f *File) close() error {
+	switch f.ctx.asyncMode {
+	case asyncIoUring:
+		// the registered table holds a reference to the file
+		f.ctx.unregisterFile(f)
+		return f.fd.Close()
+	case asyncAio:
+		return f.fd.Close()
+	default:
+		return fmt.Errorf("unknown async mode '%v'", f.ctx.asyncMode)
+	}
+}
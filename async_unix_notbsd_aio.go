@@ -4,16 +4,22 @@ package asyncfs
 
 import (
 	"errors"
-	"reflect"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
 const (
-	iocbCmdPread  = uint16(0)
-	iocbCmdPwrite = uint16(1)
-	iocbCmdFsync  = uint16(2)
-	iocbCmdFdsync = uint16(3)
+	iocbCmdPread   = uint16(0)
+	iocbCmdPwrite  = uint16(1)
+	iocbCmdFsync   = uint16(2)
+	iocbCmdFdsync  = uint16(3)
+	iocbCmdPreadv  = uint16(7)
+	iocbCmdPwritev = uint16(8)
+)
+
+const (
+	iocbFlagResfd = int32(1)
 )
 
 var bigEndian = (*(*[2]uint8)(unsafe.Pointer(&[]uint16{1}[0])))[0] == 0
@@ -51,90 +57,197 @@ type (
 	}
 )
 
-func (f *File) asyncRWAio(op uint16, data []uint8) (int, error) {
-	sz := len(data)
-	if sz == 0 {
+func (f *File) asyncRWAio(op uint16, o *Op) (int, error) {
+	if o.size() == 0 {
 		return 0, nil
 	}
+	if err := f.prepRWAio(op, o); err != nil {
+		return 0, err
+	}
+	_, err := f.ctx.submitAio(o)
+	return 0, err
+}
 
-	if len(data)%c.align != 0 || uint64(uintptr(unsafe.Pointer(&data[0])))%uint64(c.align) != 0 {
-		return 0, ErrUnalignedData
+// prepRWAio fills the iocb of the read or write
+func (f *File) prepRWAio(op uint16, o *Op) error {
+	c := f.ctx
+	iovs := o.iovecs()
+	for _, iov := range iovs {
+		if iov.Len%uint64(c.align) != 0 || uint64(uintptr(unsafe.Pointer(iov.Base)))%uint64(c.align) != 0 {
+			return ErrUnalignedData
+		}
 	}
 
-	cb := &aiocb{
+	o.cb = aiocb{
 		aioFields: uint32(f.fd.Fd()),
 		aioOpcode: op,
-		aioBuf:    uint64(uintptr(unsafe.Pointer(&data[0]))),
-		aioNbytes: uint64(sz),
-		aioOffset: f.pos,
-		aioData:   uint64(cap(data)),
+		aioBuf:    uint64(uintptr(unsafe.Pointer(iovs[0].Base))),
+		aioNbytes: iovs[0].Len,
+		aioOffset: o.off,
+	}
+	if o.bufs != nil {
+		// the vectored commands take the iovecs instead of the buffer
+		o.cb.aioOpcode = iocbCmdPreadv
+		if op == iocbCmdPwrite {
+			o.cb.aioOpcode = iocbCmdPwritev
+		}
+		o.cb.aioBuf = uint64(uintptr(unsafe.Pointer(&iovs[0])))
+		o.cb.aioNbytes = uint64(len(iovs))
+	}
+	return nil
+}
+
+// prepFsyncAio fills the iocb of fsync or fdatasync
+func (f *File) prepFsyncAio(o *Op) {
+	cmd := iocbCmdFsync
+	if o.kind == OpDatasync {
+		cmd = iocbCmdFdsync
+	}
+	o.cb = aiocb{
+		aioFields: uint32(f.fd.Fd()),
+		aioOpcode: cmd,
 	}
+}
+
+// submitAio submits the prepared iocbs of the operations with one io_submit.
+// It returns the number of the submitted operations, the rest aren't submitted.
+func (c *ctx) submitAio(ops ...*Op) (int, error) {
+	cbs := make([]*aiocb, 0, len(ops))
 	c.Lock()
-	c.operationsFd[unsafe.Pointer(cb)] = f
+	if c.closed {
+		c.Unlock()
+		return 0, ErrCtxClosed
+	}
+	for _, o := range ops {
+		cb := &o.cb
+		if c.reaping {
+			cb.aioFlags = iocbFlagResfd
+			cb.aioResfd = uint32(c.efd)
+		}
+		c.operationsFd[unsafe.Pointer(cb)] = o
+		cbs = append(cbs, cb)
+	}
 	c.Unlock()
-	n, _, e1 := syscall.RawSyscall(syscall.SYS_IO_SUBMIT, uintptr(c.aio), 1, uintptr(unsafe.Pointer(&cb)))
+	n, _, e1 := syscall.RawSyscall(syscall.SYS_IO_SUBMIT, uintptr(c.aio), uintptr(len(cbs)), uintptr(unsafe.Pointer(&cbs[0])))
 	if e1 != 0 {
-		return 0, e1
+		n = 0
 	}
-	if n != 1 {
-		return 0, ErrNotSubmittedAio
+	if int(n) != len(cbs) {
+		c.Lock()
+		for _, cb := range cbs[n:] {
+			delete(c.operationsFd, unsafe.Pointer(cb))
+		}
+		c.Unlock()
+		if e1 != 0 {
+			return 0, e1
+		}
+		return int(n), ErrNotSubmittedAio
 	}
-	return 0, nil
+	return int(n), nil
 }
 
-func (f *File) asyncWriteAio(data []uint8) (int, error) {
-	return f.asyncRWAio(iocbCmdPwrite, data)
+func (f *File) asyncFsyncAio(o *Op) error {
+	f.prepFsyncAio(o)
+	_, err := f.ctx.submitAio(o)
+	if err == syscall.EINVAL {
+		// the kernel before 4.18 doesn't support the fsync commands
+		return f.ctx.offload(o, func() (int64, error) {
+			if o.kind == OpDatasync {
+				return 0, syscall.Fdatasync(int(f.fd.Fd()))
+			}
+			return 0, syscall.Fsync(int(f.fd.Fd()))
+		})
+	}
+	return err
 }
 
-func (f *File) asyncReadAio(data []uint8) (int, error) {
-	return f.asyncRWAio(iocbCmdPread, data)
+func (c *ctx) cancelAio(o *Op) error {
+	cb := unsafe.Pointer(&o.cb)
+	c.Lock()
+	_, pending := c.operationsFd[cb]
+	c.Unlock()
+	if !pending {
+		if o.isDone() {
+			return nil
+		}
+		// the operation is offloaded to a goroutine
+		return ErrNotCancelled
+	}
+
+	var ev aioEvent
+	_, _, e := syscall.Syscall(syscall.SYS_IO_CANCEL, uintptr(c.aio), uintptr(cb), uintptr(unsafe.Pointer(&ev)))
+	switch e {
+	case 0:
+		// the result is returned here instead of the completion queue
+		c.Lock()
+		_, pending = c.operationsFd[cb]
+		delete(c.operationsFd, cb)
+		c.Unlock()
+		if pending {
+			o.setResult(ev.res)
+			c.completeOps([]*Op{o})
+		}
+		return nil
+	case syscall.EINPROGRESS:
+		// the result comes from the completion queue
+		return nil
+	case syscall.EINVAL, syscall.EAGAIN:
+		if o.isDone() {
+			return nil
+		}
+		return ErrNotCancelled
+	default:
+		return e
+	}
+}
+
+func (f *File) asyncWriteAio(o *Op) (int, error) {
+	return f.asyncRWAio(iocbCmdPwrite, o)
+}
+
+func (f *File) asyncReadAio(o *Op) (int, error) {
+	return f.asyncRWAio(iocbCmdPread, o)
 }
 
 func fillStatesAio(c *ctx) error {
-	var ts = unsafe.Pointer(&syscall.Timespec{
+	return waitStatesAio(c, 1, &syscall.Timespec{
 		Sec:  0,
 		Nsec: 0,
 	})
+}
+
+// waitStatesAio waits up to ts for at least minNr events and fills the states; nil ts waits forever
+func waitStatesAio(c *ctx, minNr int, ts *syscall.Timespec) error {
 	for {
 		sz := uintptr(c.sz)
 		if c.sz > 64 {
 			sz = uintptr(64)
 		}
 		e := make([]aioEvent, sz)
-		n, _, e1 := syscall.Syscall6(syscall.SYS_IO_GETEVENTS, uintptr(c.aio), 1, sz, uintptr(unsafe.Pointer(&e[0])), uintptr(ts), 0)
+		n, _, e1 := syscall.Syscall6(syscall.SYS_IO_GETEVENTS, uintptr(c.aio), uintptr(minNr), sz, uintptr(unsafe.Pointer(&e[0])), uintptr(unsafe.Pointer(ts)), 0)
 		if e1 != 0 {
 			return e1
 		}
 		if n > 0 {
+			completed := make([]*Op, 0, n)
 			c.Lock()
 			for i := 0; i < int(n); i++ {
 				objId := e[i].obj
 				aioCbPtr := unsafe.Pointer(uintptr(objId))
-				fd, ok := c.operationsFd[aioCbPtr]
+				o, ok := c.operationsFd[aioCbPtr]
 				if !ok {
 					continue
 				}
-				aioCb := (*aiocb)(aioCbPtr)
-
-				fd.mtx.Lock()
-				if fd.lastAsyncOpState.lastOp == OpRead {
-					var b []uint8
-					sh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
-					sh.Data = uintptr(aioCb.aioBuf)
-					sh.Len = int(aioCb.aioNbytes)
-					sh.Cap = int(e[i].data)
-					fd.lastAsyncOpState.data = b
-					fd.lastAsyncOpState.eof = aioCb.aioNbytes > 0 && e[i].res == 0
-				}
-				fd.lastAsyncOpState.result = e[i].res
-				fd.pos = aioCb.aioOffset + e[i].res
-				fd.lastAsyncOpState.complete = true
-				fd.mtx.Unlock()
+				o.setResult(e[i].res)
+				completed = append(completed, o)
 
 				delete(c.operationsFd, aioCbPtr)
 			}
 			c.Unlock()
+			c.completeOps(completed)
 			if n >= sz {
+				minNr = 0
+				ts = &syscall.Timespec{}
 				continue
 			}
 		}
@@ -142,3 +255,57 @@ func fillStatesAio(c *ctx) error {
 	}
 	return nil
 }
+
+// closeAio drains the context, the operations still in flight after closeGrace are cancelled.
+// The operations which are neither completed nor cancelled after closeGrace more are failed with ErrCtxClosed and returned,
+// the context isn't destroyed then since io_destroy would wait for them, and their buffers are never freed
+func (c *ctx) closeAio() ([]*Op, error) {
+	deadline := time.Now().Add(closeGrace)
+	cancelled := false
+	for {
+		c.Lock()
+		ops := make([]*Op, 0, len(c.operationsFd))
+		for _, o := range c.operationsFd {
+			ops = append(ops, o)
+		}
+		c.Unlock()
+		if len(ops) == 0 {
+			break
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			if cancelled {
+				break
+			}
+			for _, o := range ops {
+				_ = c.cancelAio(o)
+			}
+			cancelled = true
+			deadline = time.Now().Add(closeGrace)
+			continue
+		}
+		if left > waitSlice {
+			left = waitSlice
+		}
+		ts := syscall.NsecToTimespec(int64(left))
+		err := waitStatesAio(c, 1, &ts)
+		if err != nil && err != syscall.EINTR {
+			return nil, err
+		}
+	}
+
+	if stuck := c.failPending(); len(stuck) > 0 {
+		c.Lock()
+		c.aio = 0
+		c.Unlock()
+		return stuck, nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	_, _, e1 := syscall.RawSyscall(syscall.SYS_IO_DESTROY, uintptr(c.aio), 0, 0)
+	c.aio = 0
+	if e1 != 0 {
+		return nil, e1
+	}
+	return nil, nil
+}
@@ -22,7 +22,7 @@ func Test_asyncRWAio(t *testing.T) {
 	assert.NoError(t, err)
 	c1.sz = sz
 	c1.align = 512
-	c1.operationsFd = make(map[unsafe.Pointer]*File, sz)
+	c1.operationsFd = make(map[unsafe.Pointer]*Op, sz)
 	c1.alignedBuffers = make(map[unsafe.Pointer]slice)
 	c = &c1
 
@@ -31,19 +31,19 @@ func Test_asyncRWAio(t *testing.T) {
 	defer os.Remove(f.path)
 
 	buf := make([]uint8, 4095)
-	n, err := f.asyncRWAio(iocbCmdPwrite, buf)
+	n, err := f.asyncRWAio(iocbCmdPwrite, newOp(f, OpWrite, buf, 0))
 	assert.Equal(t, 0, n)
 	assert.EqualError(t, err, ErrUnalignedData.Error())
 
 	c.align = 11
 	buf = make([]uint8, 4096)
-	n, err = f.asyncRWAio(iocbCmdPwrite, buf)
+	n, err = f.asyncRWAio(iocbCmdPwrite, newOp(f, OpWrite, buf, 0))
 	assert.Equal(t, 0, n)
 	assert.EqualError(t, err, ErrUnalignedData.Error())
 
 	c.align = 512
 	buf = AllocBuf(4096)
-	n, err = f.asyncRWAio(iocbCmdPwrite, buf)
+	n, err = f.asyncRWAio(iocbCmdPwrite, newOp(f, OpWrite, buf, 0))
 	assert.Equal(t, 0, n)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(c.operationsFd))
@@ -61,7 +61,7 @@ func Test_fillStatesAio(t *testing.T) {
 	c = &c1
 	c.sz = sz
 	c.align = 512
-	c.operationsFd = make(map[unsafe.Pointer]*File, sz)
+	c.operationsFd = make(map[unsafe.Pointer]*Op, sz)
 	c.alignedBuffers = make(map[unsafe.Pointer]slice)
 
 	f, err := Open("/tmp/aio", syscall.O_RDWR|syscall.O_CREAT, 0644, ModeAsync)
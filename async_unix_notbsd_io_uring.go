@@ -9,7 +9,7 @@ package asyncfs
 //     return _NSIG;
 // }
 //
-// int syscall_nums(int *io_uring_setup, int *io_uring_enter) {
+// int syscall_nums(int *io_uring_setup, int *io_uring_enter, int *io_uring_register) {
 // #if defined(__NR_io_uring_setup) && defined(__NR_io_uring_enter)
 //     *io_uring_setup = __NR_io_uring_setup;
 //     *io_uring_enter = __NR_io_uring_enter;
@@ -17,13 +17,23 @@ package asyncfs
 //	   *io_uring_setup = -1;
 //	   *io_uring_enter = -1;
 // #endif
+// #if defined(__NR_io_uring_register)
+//     *io_uring_register = __NR_io_uring_register;
+// #else
+//	   *io_uring_register = -1;
+// #endif
 // }
 import "C"
 
 import (
 	"errors"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -31,10 +41,88 @@ const (
 	ioringOpNop    = 0
 	ioringOpReadv  = 1
 	ioringOpWritev = 2
+	ioringOpFsync  = 3
+
+	ioringOpReadFixed  = 4
+	ioringOpWriteFixed = 5
+
+	ioringOpTimeout       = 11
+	ioringOpTimeoutRemove = 12
+
+	ioringOpAsyncCancel = 14
+	ioringOpLinkTimeout = 15
+	ioringOpFallocate   = 17
+	ioringOpOpenat      = 18
+	ioringOpStatx       = 21
+
+	ioringOpSplice = 30
+
+	ioringOpRenameat  = 35
+	ioringOpUnlinkat  = 36
+	ioringOpMkdirat   = 37
+	ioringOpSymlinkat = 38
+	ioringOpLinkat    = 39
+
+	ioringOpFtruncate = 55
+
+	ioringSqeFixedFile  = 1 << 0
+	ioringSqeIoDrain    = 1 << 1
+	ioringSqeIoLink     = 1 << 2
+	ioringSqeIoHardlink = 1 << 3
+)
+
+const (
+	atFdCwd         = -100
+	atEmptyPath     = 0x1000
+	statxBasicStats = 0x7ff
+)
+
+// pathOpcodes are the opcodes of the operations which aren't bound to a file
+var pathOpcodes = map[int]uint8{
+	OpStat:    ioringOpStatx,
+	OpRename:  ioringOpRenameat,
+	OpUnlink:  ioringOpUnlinkat,
+	OpMkdir:   ioringOpMkdirat,
+	OpLink:    ioringOpLinkat,
+	OpSymlink: ioringOpSymlinkat,
+}
+
+const (
+	ioringFsyncDatasync = uint32(0x1)
+)
+
+const (
+	ioringFeatSingleMmap     = uint32(0x1)
+	ioringFeatSqpollNonfixed = uint32(0x80)
+	ioringFeatExtArg         = uint32(0x100)
+)
+
+const (
+	ioringEnterGetevents = uint32(0x1)
+	ioringEnterSqWakeup  = uint32(0x2)
+	ioringEnterExtArg    = uint32(0x8)
 )
 
 const (
-	ioringFeatSingleMmap = uint32(0x1)
+	ioringSetupIoPoll = uint32(0x1)
+	ioringSetupSqPoll = uint32(0x2)
+	ioringSetupSqAff  = uint32(0x4)
+)
+
+const (
+	ioringSqNeedWakeup = uint32(0x1)
+)
+
+const (
+	ioringRegisterBuffers     = 0
+	ioringUnregisterBuffers   = 1
+	ioringRegisterFiles       = 2
+	ioringUnregisterFiles     = 3
+	ioringRegisterEventFd     = 4
+	ioringRegisterFilesUpdate = 6
+	ioringRegisterProbe       = 8
+
+	ioUringOpSupported = uint16(0x1)
 )
 
 const (
@@ -44,19 +132,19 @@ const (
 )
 
 var (
-	nSig            int
-	ioUringSetupSys int
-	ioUringEnterSys int
+	nSig               int
+	ioUringSetupSys    int
+	ioUringEnterSys    int
+	ioUringRegisterSys int
 )
 
-var errFailedSq = errors.New("bad sync internal state with kernel ring state on the SQ side")
 var errBadSize = errors.New("bad size of the queue")
 
 func init() {
 	nSig = (int)(C.nsig())
-	var ioSetup, ioEnter C.int
-	C.syscall_nums(&ioSetup, &ioEnter)
-	ioUringSetupSys, ioUringEnterSys = (int)(ioSetup), (int)(ioEnter)
+	var ioSetup, ioEnter, ioRegister C.int
+	C.syscall_nums(&ioSetup, &ioEnter, &ioRegister)
+	ioUringSetupSys, ioUringEnterSys, ioUringRegisterSys = (int)(ioSetup), (int)(ioEnter), (int)(ioRegister)
 }
 
 type (
@@ -70,7 +158,73 @@ type (
 		len      uint32 /* buffer size or number of iovecs */
 		sqeFlags uint32
 		userData uint64 /* data to be passed back at completion time */
-		pad      [3]uint64
+		bufIndex uint16 /* index into fixed buffers, if used */
+		persona  uint16
+		spliceIn int32
+		pad      [2]uint64
+	}
+
+	// probe is struct io_uring_probe with the room for all the opcodes
+	probe struct {
+		lastOp uint8
+		opsLen uint8
+		resv   uint16
+		resv2  [3]uint32
+		ops    [256]probeOp
+	}
+
+	probeOp struct {
+		op    uint8
+		resv  uint8
+		flags uint16
+		resv2 uint32
+	}
+
+	// statxBuf is struct statx
+	statxBuf struct {
+		mask       uint32
+		blksize    uint32
+		attributes uint64
+		nlink      uint32
+		uid        uint32
+		gid        uint32
+		mode       uint16
+		_          uint16
+		ino        uint64
+		size       uint64
+		blocks     uint64
+		attrMask   uint64
+		atime      statxTimestamp
+		btime      statxTimestamp
+		ctime      statxTimestamp
+		mtime      statxTimestamp
+		rdevMajor  uint32
+		rdevMinor  uint32
+		devMajor   uint32
+		devMinor   uint32
+		_          [14]uint64
+	}
+
+	statxTimestamp struct {
+		sec  int64
+		nsec uint32
+		_    int32
+	}
+
+	// spliceArgs are the descriptors and the offsets of IORING_OP_SPLICE
+	spliceArgs struct {
+		fdIn   int32
+		offIn  int64
+		fdOut  int32
+		offOut int64
+	}
+
+	// statInfo is os.FileInfo made from struct statx
+	statInfo struct {
+		name    string
+		size    int64
+		mode    os.FileMode
+		modTime time.Time
 	}
 
 	sQueue struct {
@@ -144,6 +298,24 @@ type (
 		cqOff        ioCqOffsets
 	}
 
+	filesUpdate struct {
+		offset uint32
+		resv   uint32
+		fds    uint64
+	}
+
+	kernelTimespec struct {
+		sec  int64
+		nsec int64
+	}
+
+	getEventsArg struct {
+		sigmask   uint64
+		sigmaskSz uint32
+		pad       uint32
+		ts        uint64
+	}
+
 	ring struct {
 		sq       sQueue
 		cq       cQueue
@@ -151,11 +323,6 @@ type (
 		ringFd   int
 		features uint32
 	}
-
-	cqUserData struct {
-		buf syscall.Iovec
-		cap int
-	}
 )
 
 func unmap(sq *sQueue, cq *cQueue) {
@@ -165,7 +332,190 @@ func unmap(sq *sQueue, cq *cQueue) {
 	}
 }
 
+func teardown(r *ring) error {
+	if len(r.sq.sqes) > 0 {
+		_, _, _ = syscall.RawSyscall(syscall.SYS_MUNMAP, uintptr(unsafe.Pointer(&r.sq.sqes[0])), uintptr(len(r.sq.sqes))*unsafe.Sizeof(sqe{}), 0)
+	}
+	unmap(&r.sq, &r.cq)
+	r.sq.sqes = nil
+	r.sq.array = nil
+	r.cq.cqes = nil
+	return syscall.Close(r.ringFd)
+}
+
+// registerEventFd makes the kernel signal efd every time a completion is posted to the CQ
+func registerEventFd(r *ring, efd int) error {
+	if ioUringRegisterSys <= 0 {
+		return ErrNotSupported
+	}
+	fd := int32(efd)
+	_, _, e := syscall.Syscall6(uintptr(ioUringRegisterSys), uintptr(r.ringFd), ioringRegisterEventFd, uintptr(unsafe.Pointer(&fd)), 1, 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// registerBuffers registers the buffers with the ring, the kernel pins their pages once instead of every operation
+func registerBuffers(r *ring, bufs [][]uint8) error {
+	if ioUringRegisterSys <= 0 {
+		return ErrNotSupported
+	}
+	iovs := make([]syscall.Iovec, 0, len(bufs))
+	for _, b := range bufs {
+		iovs = append(iovs, newIovec(&b[0], len(b)))
+	}
+	_, _, e := syscall.Syscall6(uintptr(ioUringRegisterSys), uintptr(r.ringFd), ioringRegisterBuffers, uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)), 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func unregisterBuffers(r *ring) error {
+	_, _, e := syscall.Syscall6(uintptr(ioUringRegisterSys), uintptr(r.ringFd), ioringUnregisterBuffers, 0, 0, 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// registerFiles registers the file table with the ring, -1 is a free slot
+func registerFiles(r *ring, fds []int32) error {
+	if ioUringRegisterSys <= 0 {
+		return ErrNotSupported
+	}
+	_, _, e := syscall.Syscall6(uintptr(ioUringRegisterSys), uintptr(r.ringFd), ioringRegisterFiles, uintptr(unsafe.Pointer(&fds[0])), uintptr(len(fds)), 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// updateFiles sets the slot of the registered table to fd, -1 releases the slot
+func updateFiles(r *ring, slot int, fd int32) error {
+	up := filesUpdate{
+		offset: uint32(slot),
+		fds:    uint64(uintptr(unsafe.Pointer(&fd))),
+	}
+	_, _, e := syscall.Syscall6(uintptr(ioUringRegisterSys), uintptr(r.ringFd), ioringRegisterFilesUpdate, uintptr(unsafe.Pointer(&up)), 1, 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func unregisterFiles(r *ring) error {
+	_, _, e := syscall.Syscall6(uintptr(ioUringRegisterSys), uintptr(r.ringFd), ioringUnregisterFiles, 0, 0, 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// probeOps returns the opcodes supported by the kernel, nil is returned if the kernel can't tell
+func probeOps(r *ring) []bool {
+	if ioUringRegisterSys <= 0 {
+		return nil
+	}
+	var p probe
+	_, _, e := syscall.Syscall6(uintptr(ioUringRegisterSys), uintptr(r.ringFd), ioringRegisterProbe, uintptr(unsafe.Pointer(&p)), uintptr(len(p.ops)), 0, 0)
+	if e != 0 {
+		return nil
+	}
+	supported := make([]bool, len(p.ops))
+	for _, op := range p.ops[:p.opsLen] {
+		supported[op.op] = op.flags&ioUringOpSupported != 0
+	}
+	return supported
+}
+
+func (stx *statxBuf) fileInfo(name string) os.FileInfo {
+	mode := os.FileMode(stx.mode & 0777)
+	switch uint32(stx.mode) & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if stx.mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if stx.mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if stx.mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return &statInfo{
+		name:    name,
+		size:    int64(stx.size),
+		mode:    mode,
+		modTime: time.Unix(stx.mtime.sec, int64(stx.mtime.nsec)),
+	}
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.size }
+func (fi *statInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *statInfo) ModTime() time.Time { return fi.modTime }
+func (fi *statInfo) IsDir() bool        { return fi.mode.IsDir() }
+
+// Sys returns nil, struct statx isn't exported
+func (fi *statInfo) Sys() interface{} { return nil }
+
+// syscallMode converts the permissions to the mode of open(2)
+func syscallMode(perm os.FileMode) uint32 {
+	mode := uint32(perm.Perm())
+	if perm&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if perm&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if perm&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
 func setup(entries uint32, r *ring, flags uint32) error {
+	return setupParams(entries, r, ioParams{flags: flags})
+}
+
+// setupOptions sets up the ring with the options of the context
+func setupOptions(entries uint32, r *ring, opts RingOptions) error {
+	var p ioParams
+	if opts.IOPoll {
+		p.flags |= ioringSetupIoPoll
+	}
+	if opts.SQPoll {
+		p.flags |= ioringSetupSqPoll
+		p.sqThreadIdle = uint32(opts.SQThreadIdle / time.Millisecond)
+		if opts.SQAffinity {
+			p.flags |= ioringSetupSqAff
+			p.sqThreadCpu = uint32(opts.SQThreadCPU)
+		}
+	}
+	return setupParams(entries, r, p)
+}
+
+// sqPollUsable reports whether the ring polled by the kernel thread can take the files which aren't registered,
+// before 5.11 (IORING_FEAT_SQPOLL_NONFIXED) their sqes fail with EBADF
+func sqPollUsable(r *ring) bool {
+	return r.flags&ioringSetupSqPoll == 0 || r.features&ioringFeatSqpollNonfixed != 0
+}
+
+// setupParams sets up the ring, p carries the flags and the settings of the kernel thread
+func setupParams(entries uint32, r *ring, p ioParams) error {
 	if entries != 0 && (entries&(entries-1)) != 0 {
 		return errBadSize
 	}
@@ -174,7 +524,6 @@ func setup(entries uint32, r *ring, flags uint32) error {
 		return ErrNotSupported
 	}
 
-	var p ioParams
 	r1, _, e := syscall.RawSyscall(uintptr(ioUringSetupSys), uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
 	if e != 0 {
 		if e == syscall.ENOSYS {
@@ -196,6 +545,7 @@ func setup(entries uint32, r *ring, flags uint32) error {
 		uintptr(r.ringFd),
 		uintptr(ioringOffSqRing))
 	if e != 0 {
+		_ = syscall.Close(r.ringFd)
 		return e
 	}
 	r.sq.sqRingFd = unsafe.Pointer(sqPtr)
@@ -213,6 +563,7 @@ func setup(entries uint32, r *ring, flags uint32) error {
 			uintptr(ioringOffCqRing))
 		if e != 0 {
 			unmap(&r.sq, &r.cq)
+			_ = syscall.Close(r.ringFd)
 			return e
 		}
 		r.cq.cqRingFd = unsafe.Pointer(cqPtr)
@@ -242,6 +593,7 @@ func setup(entries uint32, r *ring, flags uint32) error {
 		uintptr(ioringOffSqes))
 	if e != 0 {
 		unmap(&r.sq, &r.cq)
+		_ = syscall.Close(r.ringFd)
 		return e
 	}
 	var b []sqe
@@ -264,7 +616,7 @@ func setup(entries uint32, r *ring, flags uint32) error {
 	cqHdr.Cap = int(p.cqEntries)
 	cq.cqes = cqeSlice
 
-	p.flags = flags
+	r.flags = p.flags
 	r.features = p.features
 
 	return nil
@@ -272,7 +624,8 @@ func setup(entries uint32, r *ring, flags uint32) error {
 
 func getSqe(r *ring) *sqe {
 	sq := &r.sq
-	head := *sq.khead
+	// the head is moved by the kernel thread concurrently in SQPOLL mode
+	head := atomic.LoadUint32(sq.khead)
 	next := sq.sqeTail + 1
 	var s *sqe
 	if next-head <= *sq.kringEntries {
@@ -301,46 +654,491 @@ func rw(op uint8, ioSqe *sqe, fd int, addr unsafe.Pointer, userData unsafe.Point
 	ioSqe.len = len
 	ioSqe.sqeFlags = 0
 	ioSqe.userData = uint64(uintptr(userData))
+	ioSqe.bufIndex = 0
+	ioSqe.persona = 0
+	ioSqe.spliceIn = 0
 	ioSqe.pad[0] = 0
 	ioSqe.pad[1] = 0
-	ioSqe.pad[2] = 0
 	return true
 }
 
-func (f *File) asyncRWIoUring(op uint8, data []uint8) (int, error) {
-	userData, ok := c.ioUringUserDataPool.Get().(*cqUserData)
-	if !ok || userData == nil {
-		userData = &cqUserData{}
+// rwFixed prepares IORING_OP_READ_FIXED/IORING_OP_WRITE_FIXED, addr must lie inside the registered buffer bufIndex
+func rwFixed(op uint8, ioSqe *sqe, fd int, addr unsafe.Pointer, userData unsafe.Pointer, len uint32, offset int64, bufIndex uint16) bool {
+	if op != ioringOpReadFixed && op != ioringOpWriteFixed {
+		return false
+	}
+	if ioSqe == nil || addr == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   op,
+		fd:       int32(fd),
+		off:      uint64(offset),
+		addr:     uint64(uintptr(addr)),
+		len:      len,
+		userData: uint64(uintptr(userData)),
+		bufIndex: bufIndex,
+	}
+	return true
+}
+
+// prepRW prepares the read or the write, the fixed version is used if the buffer lies inside a registered one
+func prepRW(op uint8, o *Op, s *sqe) bool {
+	fd := int(o.f.fd.Fd())
+	if o.bufs == nil && len(o.buf) > 0 {
+		if idx, ok := o.f.ctx.fixedBufIndex(o.buf); ok {
+			fixedOp := uint8(ioringOpReadFixed)
+			if op == ioringOpWritev {
+				fixedOp = ioringOpWriteFixed
+			}
+			return rwFixed(fixedOp, s, fd, unsafe.Pointer(&o.buf[0]), unsafe.Pointer(o), uint32(len(o.buf)), o.off, uint16(idx))
+		}
+	}
+	iovs := o.iovecs()
+	return rw(op, s, fd, unsafe.Pointer(&iovs[0]), unsafe.Pointer(o), uint32(len(iovs)), o.off)
+}
+
+func fsync(ioSqe *sqe, fd int, userData unsafe.Pointer, flags uint32) bool {
+	if ioSqe == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   ioringOpFsync,
+		fd:       int32(fd),
+		sqeFlags: flags,
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+func fallocate(ioSqe *sqe, fd int, userData unsafe.Pointer, off, length int64, mode uint32) bool {
+	if ioSqe == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   ioringOpFallocate,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(length),
+		len:      mode,
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+func ftruncate(ioSqe *sqe, fd int, userData unsafe.Pointer, size int64) bool {
+	if ioSqe == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   ioringOpFtruncate,
+		fd:       int32(fd),
+		off:      uint64(size),
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+func openat(ioSqe *sqe, dfd int, path *byte, flag int, mode uint32, userData unsafe.Pointer) bool {
+	if ioSqe == nil || path == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   ioringOpOpenat,
+		fd:       int32(dfd),
+		addr:     uint64(uintptr(unsafe.Pointer(path))),
+		len:      mode,
+		sqeFlags: uint32(flag | syscall.O_CLOEXEC),
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+func statx(ioSqe *sqe, dfd int, path *byte, flags uint32, stx *statxBuf, userData unsafe.Pointer) bool {
+	if ioSqe == nil || path == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   ioringOpStatx,
+		fd:       int32(dfd),
+		off:      uint64(uintptr(unsafe.Pointer(stx))),
+		addr:     uint64(uintptr(unsafe.Pointer(path))),
+		len:      statxBasicStats,
+		sqeFlags: flags,
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+// pathAt prepares the operation on the paths relative to the current directory,
+// name2 is the second path and arg is the length field of the opcode
+func pathAt(ioSqe *sqe, op uint8, name, name2 *byte, arg uint32, userData unsafe.Pointer) bool {
+	if ioSqe == nil || name == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   op,
+		fd:       atFdCwd,
+		addr:     uint64(uintptr(unsafe.Pointer(name))),
+		off:      uint64(uintptr(unsafe.Pointer(name2))),
+		len:      arg,
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+// prepPath prepares the sqe of the operation which isn't bound to a file
+func prepPath(o *Op, s *sqe) bool {
+	cwd := int32(atFdCwd)
+	switch o.kind {
+	case OpStat:
+		return statx(s, atFdCwd, o.name, 0, &o.stx, unsafe.Pointer(o))
+	case OpRename:
+		// the new path is relative to the current directory too
+		return pathAt(s, ioringOpRenameat, o.name, o.name2, uint32(cwd), unsafe.Pointer(o))
+	case OpUnlink:
+		return pathAt(s, ioringOpUnlinkat, o.name, nil, 0, unsafe.Pointer(o))
+	case OpMkdir:
+		return pathAt(s, ioringOpMkdirat, o.name, nil, syscallMode(os.FileMode(o.mode)), unsafe.Pointer(o))
+	case OpLink:
+		return pathAt(s, ioringOpLinkat, o.name, o.name2, uint32(cwd), unsafe.Pointer(o))
+	case OpSymlink:
+		return pathAt(s, ioringOpSymlinkat, o.name, o.name2, 0, unsafe.Pointer(o))
+	default:
+		return false
+	}
+}
+
+// splice prepares IORING_OP_SPLICE, the offset of a pipe is -1
+func splice(ioSqe *sqe, sp *spliceArgs, n uint32, userData unsafe.Pointer) bool {
+	if ioSqe == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   ioringOpSplice,
+		fd:       sp.fdOut,
+		off:      uint64(sp.offOut),
+		addr:     uint64(sp.offIn),
+		len:      n,
+		spliceIn: sp.fdIn,
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+func asyncCancel(ioSqe *sqe, target unsafe.Pointer, userData unsafe.Pointer) bool {
+	if ioSqe == nil || target == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   ioringOpAsyncCancel,
+		fd:       -1,
+		addr:     uint64(uintptr(target)),
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+// linkTimeout prepares IORING_OP_LINK_TIMEOUT for the previous sqe, which must have IOSQE_IO_LINK
+func linkTimeout(ioSqe *sqe, ts *kernelTimespec, userData unsafe.Pointer) bool {
+	if ioSqe == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   ioringOpLinkTimeout,
+		fd:       -1,
+		addr:     uint64(uintptr(unsafe.Pointer(ts))),
+		len:      1,
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+// standaloneTimeout prepares IORING_OP_TIMEOUT which isn't bound to an operation, it is completed with ETIME once ts expires
+func standaloneTimeout(ioSqe *sqe, ts *kernelTimespec, userData unsafe.Pointer) bool {
+	if ioSqe == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   ioringOpTimeout,
+		fd:       -1,
+		addr:     uint64(uintptr(unsafe.Pointer(ts))),
+		len:      1,
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+// timeoutRemove prepares IORING_OP_TIMEOUT_REMOVE, the removed timeout is completed with ECANCELED
+func timeoutRemove(ioSqe *sqe, target unsafe.Pointer, userData unsafe.Pointer) bool {
+	if ioSqe == nil || userData == nil {
+		return false
+	}
+	*ioSqe = sqe{
+		opcode:   ioringOpTimeoutRemove,
+		fd:       -1,
+		addr:     uint64(uintptr(target)),
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+// drain prepares IORING_OP_NOP with IOSQE_IO_DRAIN, it isn't started until the previous sqes are completed
+// and the following sqes aren't started until it is completed
+func drain(ioSqe *sqe, userData unsafe.Pointer) bool {
+	if ioSqe == nil || userData == nil {
+		return false
 	}
-	userData.buf = newIovec(&data[0], len(data))
-	userData.cap = cap(data)
+	*ioSqe = sqe{
+		opcode:   ioringOpNop,
+		flags:    ioringSqeIoDrain,
+		fd:       -1,
+		userData: uint64(uintptr(userData)),
+	}
+	return true
+}
+
+// splice moves n bytes between the descriptors with IORING_OP_SPLICE and waits for the result,
+// one of them must be a pipe and its offset is -1
+func (c *ctx) splice(fdIn int, offIn int64, fdOut int, offOut int64, n int64) (int64, error) {
+	o := newCtxOp(c, opSplice)
+	o.internal = true
+	o.sp = spliceArgs{
+		fdIn:   int32(fdIn),
+		offIn:  offIn,
+		fdOut:  int32(fdOut),
+		offOut: offOut,
+	}
+	o.length = n
+	if err := c.submitIoUring([]*Op{o}, prepIoUring); err != nil {
+		return 0, err
+	}
+	if err := o.Wait(-1); err != nil {
+		return 0, err
+	}
+	return o.result, o.err
+}
+
+// cancelIoUring submits IORING_OP_ASYNC_CANCEL and waits for its result
+func (c *ctx) cancelIoUring(o *Op) error {
+	co := newCtxOp(c, opCancel)
+	co.internal = true
+	err := c.submitIoUring([]*Op{co}, func(co *Op, s *sqe) bool {
+		return asyncCancel(s, unsafe.Pointer(o), unsafe.Pointer(co))
+	})
+	if err != nil {
+		return err
+	}
+	if err := co.Wait(-1); err != nil {
+		return err
+	}
+	switch co.err {
+	case nil, syscall.ENOENT:
+		// cancelled or already completed
+		return nil
+	case syscall.EALREADY:
+		return ErrNotCancelled
+	default:
+		return co.err
+	}
+}
+
+func (f *File) asyncRWIoUring(op uint8, o *Op) (int, error) {
+	return 0, f.ctx.submitIoUring([]*Op{o}, func(o *Op, s *sqe) bool {
+		return prepRW(op, o, s)
+	})
+}
+
+func (f *File) asyncFsyncIoUring(o *Op) error {
+	return f.ctx.submitIoUring([]*Op{o}, prepIoUring)
+}
+
+// prepIoUring prepares the sqe of the operation by its kind
+func prepIoUring(o *Op, s *sqe) bool {
+	switch {
+	case o.kind == OpBarrier:
+		// the barrier isn't bound to a file
+		return drain(s, unsafe.Pointer(o))
+	case o.kind == opSplice:
+		return splice(s, &o.sp, uint32(o.length), unsafe.Pointer(o))
+	case o.kind == OpOpen:
+		// the file isn't opened yet
+		return openat(s, atFdCwd, o.name, o.flag, syscallMode(os.FileMode(o.mode)), unsafe.Pointer(o))
+	case o.f == nil:
+		return prepPath(o, s)
+	case o.kind == OpStat:
+		return statx(s, int(o.f.fd.Fd()), o.name, atEmptyPath, &o.stx, unsafe.Pointer(o))
+	}
+	fd := int(o.f.fd.Fd())
+	switch o.kind {
+	case OpRead:
+		return prepRW(ioringOpReadv, o, s)
+	case OpWrite:
+		return prepRW(ioringOpWritev, o, s)
+	case OpSync:
+		return fsync(s, fd, unsafe.Pointer(o), 0)
+	case OpDatasync:
+		return fsync(s, fd, unsafe.Pointer(o), ioringFsyncDatasync)
+	case OpAllocate:
+		return fallocate(s, fd, unsafe.Pointer(o), o.off, o.length, o.mode)
+	case OpTruncate:
+		return ftruncate(s, fd, unsafe.Pointer(o), o.off)
+	default:
+		return false
+	}
+}
+
+// submitIoUring prepares the sqes of the operations with prep and submits them with one io_uring_enter.
+// Nothing is submitted if some sqe can't be prepared.
+func (c *ctx) submitIoUring(ops []*Op, prep func(o *Op, s *sqe) bool) error {
+	_, err := c.submitIoUringN(ops, prep)
+	return err
+}
 
+// submitIoUringN submits the operations like submitIoUring and returns how many of them are in flight,
+// the rest aren't registered and must be failed by the caller
+func (c *ctx) submitIoUringN(ops []*Op, prep func(o *Op, s *sqe) bool) (int, error) {
 	c.Lock()
-	c.currentCnt++
-	if !rw(op, getSqe(c.r), int(f.fd.Fd()), unsafe.Pointer(&userData.buf), unsafe.Pointer(userData), 1, f.pos) {
-		c.currentCnt--
+	if c.closed {
+		c.Unlock()
+		return 0, ErrCtxClosed
+	}
+	return c.queueIoUring(ops, prep)
+}
+
+// queueIoUring prepares and submits the sqes like submitIoUringN, the ctx lock must be held and it is released.
+// The flushed sqes can't be taken back, so the kernel consumes them with the next io_uring_enter
+// if this one fails for a while: the operations are completed through their cqes then
+func (c *ctx) queueIoUring(ops []*Op, prep func(o *Op, s *sqe) bool) (int, error) {
+	var taken uint32
+	added := make([]*Op, 0, len(ops))
+	// first are the indexes of the operations in added, which are the positions of their sqes too
+	first := make([]int, 0, len(ops))
+	rollback := func() (int, error) {
+		// the sqes aren't flushed yet, so they are taken back
+		c.r.sq.sqeTail -= taken
+		for _, prev := range added {
+			prev.fixed = false
+			delete(c.operationsFd, unsafe.Pointer(prev))
+		}
 		c.Unlock()
 		return 0, ErrNotSubmittedIoUring
 	}
-	c.operationsFd[unsafe.Pointer(userData)] = f
+	for _, o := range ops {
+		first = append(first, len(added))
+		s := getSqe(c.r)
+		if s != nil {
+			taken++
+		}
+		if !prep(o, s) {
+			return rollback()
+		}
+		if slot, ok := c.fixedFiles[o.f]; ok && o.kind != OpStat && s.fd == int32(o.f.fd.Fd()) {
+			// statx can't take a registered file
+			// the kernel takes the file from the registered table instead of fget/fput
+			s.fd = int32(slot)
+			s.flags |= ioringSqeFixedFile
+		}
+		s.flags |= o.link
+		o.fixed = s.opcode == ioringOpReadFixed || s.opcode == ioringOpWriteFixed
+		c.operationsFd[unsafe.Pointer(o)] = o
+		added = append(added, o)
+		if o.timeout <= 0 || o.internal || c.iopoll {
+			// the polled ring doesn't support the timeouts, the timers are armed by submit
+			continue
+		}
+
+		// the kernel cancels the operation when the linked timeout fires
+		s.flags |= ioringSqeIoLink
+		o.ts = kernelTimespec{sec: int64(o.timeout / time.Second), nsec: int64(o.timeout % time.Second)}
+		to := newOp(o.f, opLinkTimeout, nil, 0)
+		to.internal = true
+		ts := getSqe(c.r)
+		if ts != nil {
+			taken++
+		}
+		if !linkTimeout(ts, &o.ts, unsafe.Pointer(to)) {
+			return rollback()
+		}
+		// the chain continues after the timeout
+		ts.flags |= o.link
+		c.operationsFd[unsafe.Pointer(to)] = to
+		added = append(added, to)
+	}
+	c.currentCnt += len(added)
+	for _, o := range added {
+		if o.fixed {
+			c.fixedCnt++
+		}
+	}
+	base := atomic.LoadUint32(c.r.sq.ktail)
 	submit := flushSq(c.r)
 	c.Unlock()
+	if c.r.flags&ioringSetupSqPoll != 0 {
+		// the thread takes the entries by itself, it is woken up by the next submission or wait if this wakeup fails
+		_ = wakeupSqThread(c.r)
+		return len(ops), nil
+	}
 	if submit == 0 {
-		return 0, errFailedSq
+		// a concurrent io_uring_enter has consumed the entries
+		return len(ops), nil
 	}
 	_, _, e := syscall.RawSyscall6(uintptr(ioUringEnterSys), uintptr(c.r.ringFd), uintptr(submit), 0, 0, 0, uintptr(nSig/8))
+	switch e {
+	case 0, syscall.EAGAIN, syscall.EBUSY, syscall.EINTR:
+		// the entries the kernel hasn't taken yet are submitted by the next io_uring_enter
+		return len(ops), nil
+	}
+
+	// the ring is broken, the operations the kernel hasn't consumed are unregistered
+	c.Lock()
+	defer c.Unlock()
+	head := atomic.LoadUint32(c.r.sq.khead)
+	n := 0
+	for n < len(ops) && int32(base+uint32(first[n])-head) < 0 {
+		n++
+	}
+	if n < len(ops) {
+		for _, o := range added[first[n]:] {
+			delete(c.operationsFd, unsafe.Pointer(o))
+		}
+		c.currentCnt -= len(added) - first[n]
+		c.unfixLocked(added[first[n]:])
+	}
+	return n, e
+}
+
+// resubmit submits the entries left in the ring by a failed io_uring_enter, the completions of their operations are waited for
+func resubmit(r *ring) {
+	if r.flags&ioringSetupSqPoll != 0 {
+		_ = wakeupSqThread(r)
+		return
+	}
+	if toSubmit := atomic.LoadUint32(r.sq.ktail) - atomic.LoadUint32(r.sq.khead); toSubmit > 0 {
+		_, _, _ = syscall.Syscall6(uintptr(ioUringEnterSys), uintptr(r.ringFd), uintptr(toSubmit), 0, 0, 0, uintptr(nSig/8))
+	}
+}
+
+// wakeupSqThread wakes up the kernel thread polling the submission queue if it sleeps,
+// otherwise the thread takes the flushed entries by itself and no syscall is needed
+func wakeupSqThread(r *ring) error {
+	// the tail is stored atomically by flushSq, so the flags are read after the kernel sees the new entries
+	if atomic.LoadUint32(r.sq.kflags)&ioringSqNeedWakeup == 0 {
+		return nil
+	}
+	_, _, e := syscall.RawSyscall6(uintptr(ioUringEnterSys), uintptr(r.ringFd), 0, 0, uintptr(ioringEnterSqWakeup), 0, uintptr(nSig/8))
 	if e != 0 {
-		return 0, e
+		return e
 	}
-	return 0, nil
+	return nil
 }
 
-func (f *File) asyncWriteIoUring(data []uint8) (int, error) {
-	return f.asyncRWIoUring(ioringOpWritev, data)
+func (f *File) asyncWriteIoUring(o *Op) (int, error) {
+	return f.asyncRWIoUring(ioringOpWritev, o)
 }
 
-func (f *File) asyncReadIoUring(data []uint8) (int, error) {
-	return f.asyncRWIoUring(ioringOpReadv, data)
+func (f *File) asyncReadIoUring(o *Op) (int, error) {
+	return f.asyncRWIoUring(ioringOpReadv, o)
 }
 
 func flushSq(r *ring) int {
@@ -353,53 +1151,363 @@ func flushSq(r *ring) int {
 		ktail++
 		sq.sqeHead++
 	}
-	*sq.ktail = ktail
-	return int(ktail - *sq.khead)
+	atomic.StoreUint32(sq.ktail, ktail)
+	return int(ktail - atomic.LoadUint32(sq.khead))
 }
 
 func fillStatesIoUring(c *ctx) {
 	c.Lock()
-	defer c.Unlock()
+	if c.iopoll && c.r != nil {
+		// the completions of the polled ring are posted to the CQ only while somebody polls the device
+		r := c.r
+		c.Unlock()
+		_, _, _ = syscall.Syscall6(uintptr(ioUringEnterSys), uintptr(r.ringFd), 0, 0, uintptr(ioringEnterGetevents), 0, uintptr(nSig/8))
+		c.Lock()
+	}
 
 	r := c.r
+	if r == nil {
+		c.Unlock()
+		return
+	}
 	head := *r.cq.khead
 	available := *r.cq.ktail - head
 
+	var completed, unpolled []*Op
 	for ; ; head++ {
 		if *r.cq.ktail-head == 0 {
 			break
 		}
 		cqe := r.cq.cqes[head&(*r.cq.kringMask)]
 		ptrData := unsafe.Pointer(uintptr(cqe.userData))
-		fd, ok := c.operationsFd[ptrData]
+		o, ok := c.operationsFd[ptrData]
 		if !ok {
 			continue
 		}
-		userData := (*cqUserData)(ptrData)
+		delete(c.operationsFd, ptrData)
+		if c.iopoll && cqe.res == -int32(syscall.EOPNOTSUPP) && !o.internal {
+			// the device can't be polled
+			unpolled = append(unpolled, o)
+			continue
+		}
+		o.setResult(int64(cqe.res))
+		o.finishIoUring()
+		completed = append(completed, o)
+	}
+	*r.cq.khead = *r.cq.khead + available
+
+	c.currentCnt -= int(available)
+	c.unfixLocked(completed)
+	c.unfixLocked(unpolled)
+	c.Unlock()
 
-		fd.mtx.Lock()
-		if fd.lastAsyncOpState.lastOp == OpRead {
-			var b []uint8
-			hdr := (*reflect.SliceHeader)(unsafe.Pointer(&b))
-			hdr.Data = uintptr(unsafe.Pointer(userData.buf.Base))
-			hdr.Len = int(userData.buf.Len)
-			hdr.Cap = userData.cap
-			fd.lastAsyncOpState.data = b
-			fd.lastAsyncOpState.eof = userData.buf.Len > 0 && cqe.res == 0
+	for _, o := range unpolled {
+		atomic.StoreInt32(&o.f.unpolled, 1)
+		if err := c.offloadSync(o); err != nil {
+			o.err = err
+			completed = append(completed, o)
 		}
-		fd.lastAsyncOpState.result = int64(cqe.res)
-		fd.pos += int64(cqe.res)
-		fd.lastAsyncOpState.complete = true
-		fd.mtx.Unlock()
+	}
+	c.completeOps(completed)
+}
 
-		userData.cap = 0
-		userData.buf.Len = 0
-		userData.buf.Base = nil
-		c.ioUringUserDataPool.Put(userData)
+// submitOrOffload submits the operation with the opcode if the kernel supports it, otherwise it is offloaded
+func (f *File) submitOrOffload(op uint8, o *Op) error {
+	c := f.ctx
+	if c.supports(op) {
+		if err := o.setNames(); err != nil {
+			return err
+		}
+		return c.submitIoUring([]*Op{o}, prepIoUring)
+	}
+	if err := c.offloadSync(o); err != nil {
+		return err
+	}
+	c.armTimers(o)
+	return nil
+}
 
-		delete(c.operationsFd, ptrData)
+// submitPathIoUring submits the operation on the path if the kernel supports it, otherwise it is offloaded
+func (c *ctx) submitPathIoUring(o *Op) error {
+	if op, ok := pathOpcodes[o.kind]; !ok || !c.supports(op) {
+		return c.offloadPath(o)
 	}
-	*r.cq.khead = *r.cq.khead + available
+	if err := o.setNames(); err != nil {
+		return err
+	}
+	return c.submitIoUring([]*Op{o}, prepIoUring)
+}
 
-	c.currentCnt -= int(available)
+// setNames makes the NUL-terminated paths of the operation which the kernel reads
+func (o *Op) setNames() error {
+	var err error
+	switch o.kind {
+	case OpOpen, OpStat, OpUnlink, OpMkdir:
+		o.name, err = syscall.BytePtrFromString(o.path)
+	case OpRename, OpLink, OpSymlink:
+		if o.name, err = syscall.BytePtrFromString(o.path); err == nil {
+			o.name2, err = syscall.BytePtrFromString(o.path2)
+		}
+	}
+	return err
+}
+
+// finishIoUring makes the results of the operation from the kernel structures, the lock is held
+func (o *Op) finishIoUring() {
+	if o.err != nil {
+		return
+	}
+	switch o.kind {
+	case OpOpen:
+		o.f.fd = os.NewFile(uintptr(o.result), o.f.path)
+	case OpStat:
+		name := o.path
+		if o.f != nil {
+			name = o.f.path
+		}
+		o.info = o.stx.fileInfo(filepath.Base(name))
+	}
+}
+
+// supports reports whether the kernel supports the opcode
+func (c *ctx) supports(op uint8) bool {
+	return int(op) < len(c.opcodes) && c.opcodes[op]
+}
+
+// offloadSync does the operation with the synchronous calls on a goroutine
+func (c *ctx) offloadSync(o *Op) error {
+	return c.offload(o, func() (int64, error) {
+		if o.kind == OpDatasync {
+			return 0, syscall.Fdatasync(int(o.f.fd.Fd()))
+		}
+		return o.f.doSync(o)
+	})
+}
+
+// submitPolled submits the operation to the polled ring, the operations it can't do are offloaded
+func (f *File) submitPolled(o *Op) error {
+	c := f.ctx
+	switch {
+	case o.kind != OpRead && o.kind != OpWrite:
+		// fsync isn't supported by the polled ring
+	case atomic.LoadInt32(&f.unpolled) == 1:
+	default:
+		for _, iov := range o.iovecs() {
+			if iov.Len%uint64(c.align) != 0 || uint64(uintptr(unsafe.Pointer(iov.Base)))%uint64(c.align) != 0 {
+				return ErrUnalignedData
+			}
+		}
+		if err := c.submitIoUring([]*Op{o}, prepIoUring); err != nil {
+			return err
+		}
+		c.armTimers(o)
+		return nil
+	}
+	if err := c.offloadSync(o); err != nil {
+		return err
+	}
+	c.armTimers(o)
+	return nil
+}
+
+// closeIoUring drains the ring, the operations still in flight after closeGrace are cancelled.
+// The operations which are neither completed nor cancelled after closeGrace more are failed with ErrCtxClosed and returned,
+// the kernel cancels them once the ring is destroyed
+func (c *ctx) closeIoUring() ([]*Op, error) {
+	deadline := time.Now().Add(closeGrace)
+	cancelled := false
+	for {
+		c.Lock()
+		pending := len(c.operationsFd)
+		toSubmit := *c.r.sq.ktail - *c.r.sq.khead
+		c.Unlock()
+		if pending == 0 {
+			break
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			if cancelled {
+				break
+			}
+			c.cancelAllIoUring()
+			cancelled = true
+			deadline = time.Now().Add(closeGrace)
+			continue
+		}
+		if toSubmit > 0 || c.r.flags&ioringSetupSqPoll != 0 {
+			// the entries flushed by a failed submission are submitted now
+			flags := uint32(0)
+			if c.r.flags&ioringSetupSqPoll != 0 {
+				flags |= ioringEnterSqWakeup
+			}
+			_, _, e := syscall.Syscall6(uintptr(ioUringEnterSys), uintptr(c.r.ringFd), uintptr(toSubmit), 0, uintptr(flags), 0, uintptr(nSig/8))
+			if e != 0 && e != syscall.EINTR && e != syscall.EAGAIN && e != syscall.EBUSY {
+				return nil, e
+			}
+		}
+		if left > waitSlice {
+			left = waitSlice
+		}
+		if err := c.waitIoUring(1, left); err != nil && err != syscall.EINTR {
+			return nil, err
+		}
+	}
+
+	stuck := c.failPending()
+	c.Lock()
+	defer c.Unlock()
+	// the operations are drained, so the registered resources are released without waiting
+	c.nextBufs = nil
+	c.bufsChanged = false
+	_ = c.setFixedBufs(nil)
+	c.unregisterFilesLocked()
+	err := teardown(c.r)
+	c.r = nil
+	return stuck, err
+}
+
+// cancelAllIoUring submits IORING_OP_ASYNC_CANCEL for every operation in flight without waiting for the results,
+// the polled operations can't be cancelled
+func (c *ctx) cancelAllIoUring() {
+	c.Lock()
+	if c.iopoll {
+		c.Unlock()
+		return
+	}
+	targets := make(map[*Op]*Op, len(c.operationsFd))
+	cos := make([]*Op, 0, len(c.operationsFd))
+	for _, o := range c.operationsFd {
+		if o.internal {
+			// the linked timeouts and the cancellations themselves
+			continue
+		}
+		co := newCtxOp(c, opCancel)
+		co.internal = true
+		targets[co] = o
+		cos = append(cos, co)
+	}
+	if len(cos) == 0 {
+		c.Unlock()
+		return
+	}
+	// the lock is released by queueIoUring
+	_, _ = c.queueIoUring(cos, func(co *Op, s *sqe) bool {
+		return asyncCancel(s, unsafe.Pointer(targets[co]), unsafe.Pointer(co))
+	})
+}
+
+func (c *ctx) waitIoUring(min int, timeout time.Duration) error {
+	c.Lock()
+	r := c.r
+	c.Unlock()
+	if r == nil {
+		return ErrCtxClosed
+	}
+
+	if c.iopoll {
+		return c.waitPolled(r, min, timeout)
+	}
+	resubmit(r)
+
+	flags := ioringEnterGetevents
+	argSz := uintptr(nSig / 8)
+	argPtr := uintptr(0)
+	var arg getEventsArg
+	var ts kernelTimespec
+	if timeout >= 0 {
+		if r.features&ioringFeatExtArg == 0 {
+			// io_uring_enter can't wait with a timeout
+			return c.waitTimeoutIoUring(r, timeout)
+		}
+		ts.sec = int64(timeout / time.Second)
+		ts.nsec = int64(timeout % time.Second)
+		arg.ts = uint64(uintptr(unsafe.Pointer(&ts)))
+		flags |= ioringEnterExtArg
+		argPtr = uintptr(unsafe.Pointer(&arg))
+		argSz = unsafe.Sizeof(arg)
+	}
+	_, _, e := syscall.Syscall6(uintptr(ioUringEnterSys), uintptr(r.ringFd), 0, uintptr(min), uintptr(flags), argPtr, argSz)
+	runtime.KeepAlive(&arg)
+	runtime.KeepAlive(&ts)
+	if e != 0 && e != syscall.ETIME && e != syscall.EINTR {
+		return e
+	}
+	fillStatesIoUring(c)
+	return nil
+}
+
+// waitTimeoutIoUring bounds the wait by IORING_OP_TIMEOUT on the kernels which can't pass the timeout to io_uring_enter.
+// The wait ends with the first completion, which may be the timeout itself, and the callers check their conditions again;
+// the kernels without IORING_OP_TIMEOUT sleep for the timeout
+func (c *ctx) waitTimeoutIoUring(r *ring, timeout time.Duration) error {
+	to := newCtxOp(c, opTimeout)
+	to.internal = true
+	to.ts = kernelTimespec{sec: int64(timeout / time.Second), nsec: int64(timeout % time.Second)}
+	c.Lock()
+	if c.r != r || !c.supports(ioringOpTimeout) {
+		c.Unlock()
+		time.Sleep(timeout)
+		fillStatesIoUring(c)
+		return nil
+	}
+	if atomic.LoadUint32(r.cq.ktail) != *r.cq.khead {
+		// the completions are posted already, the removed timeout of the previous wait among them,
+		// so they are reaped without a new timeout
+		c.Unlock()
+		fillStatesIoUring(c)
+		return nil
+	}
+	// the closing ctx waits this way too, so the timeout is queued like the cancellations of close;
+	// the lock is released by queueIoUring
+	if _, err := c.queueIoUring([]*Op{to}, func(to *Op, s *sqe) bool {
+		return standaloneTimeout(s, &to.ts, unsafe.Pointer(to))
+	}); err != nil {
+		// the ring is full
+		time.Sleep(timeout)
+		fillStatesIoUring(c)
+		return nil
+	}
+	_, _, e := syscall.Syscall6(uintptr(ioUringEnterSys), uintptr(r.ringFd), 0, 1, uintptr(ioringEnterGetevents), 0, uintptr(nSig/8))
+	fillStatesIoUring(c)
+	if !to.isDone() {
+		// something else is completed, the timeout isn't waited for
+		c.Lock()
+		if c.r == r && c.supports(ioringOpTimeoutRemove) {
+			ro := newCtxOp(c, opCancel)
+			ro.internal = true
+			_, _ = c.queueIoUring([]*Op{ro}, func(ro *Op, s *sqe) bool {
+				return timeoutRemove(s, unsafe.Pointer(to), unsafe.Pointer(ro))
+			})
+		} else {
+			c.Unlock()
+		}
+	}
+	if e != 0 && e != syscall.EINTR {
+		return e
+	}
+	return nil
+}
+
+// waitPolled polls the device, the timeout isn't supported by the polled ring.
+// The kernel returns at once if nothing is polled, so the goroutine sleeps a bit if nothing is reaped
+func (c *ctx) waitPolled(r *ring, min int, timeout time.Duration) error {
+	c.Lock()
+	start := c.completedCnt
+	c.Unlock()
+	_, _, e := syscall.Syscall6(uintptr(ioUringEnterSys), uintptr(r.ringFd), 0, uintptr(min), uintptr(ioringEnterGetevents), 0, uintptr(nSig/8))
+	if e != 0 && e != syscall.EINTR {
+		return e
+	}
+	fillStatesIoUring(c)
+	c.Lock()
+	reaped := c.completedCnt != start
+	c.Unlock()
+	if !reaped && timeout != 0 {
+		d := time.Millisecond
+		if timeout > 0 && timeout < d {
+			d = timeout
+		}
+		time.Sleep(d)
+	}
+	return nil
 }
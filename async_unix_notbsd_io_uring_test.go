@@ -3,10 +3,14 @@
 package asyncfs
 
 import (
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"runtime"
-	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -73,42 +77,33 @@ func Test_asyncRWIoUring(t *testing.T) {
 	err := setup(sz, &r, 0)
 	assert.NoError(t, err)
 
-	c = new(ctx)
-	c.ioUringUserDataPool = sync.Pool{
-		New: func() interface{} {
-			return &cqUserData{}
-		},
-	}
+	c := new(ctx)
 	c.r = &r
 
 	f := &File{
+		ctx: c,
 		pos: 100,
 	}
-	c.operationsFd = make(map[unsafe.Pointer]*File)
-	n, err := f.asyncRWIoUring(ioringOpReadv, []uint8{0x0, 0x0, 0x0})
+	c.operationsFd = make(map[unsafe.Pointer]*Op)
+	n, err := f.asyncRWIoUring(ioringOpReadv, newOp(f, OpRead, []uint8{0x0, 0x0, 0x0}, f.pos))
 	assert.Equal(t, 0, n)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, c.currentCnt)
 	assert.GreaterOrEqual(t, len(c.operationsFd), 1)
 
-	c.ioUringUserDataPool = sync.Pool{
-		New: func() interface{} {
-			return cqUserData{} // not a pointer
-		},
-	}
-	n, err = f.asyncRWIoUring(ioringOpNop, []uint8{0x0, 0x0, 0x0})
+	n, err = f.asyncRWIoUring(ioringOpNop, newOp(f, OpRead, []uint8{0x0, 0x0, 0x0}, f.pos))
 	assert.Equal(t, 0, n)
 	assert.Equal(t, ErrNotSubmittedIoUring, err)
 	assert.Equal(t, 1, c.currentCnt)
 
-	// flush -> toSubmit == 0
+	// flush -> toSubmit == 0, the entry has been consumed, so it is completed through its cqe
 	*(c.r.sq.ktail) = 0
 	*(c.r.sq.khead) = 1
 	c.r.sq.sqeTail = 0
 	c.r.sq.sqeHead = 0
-	n, err = f.asyncRWIoUring(ioringOpWritev, []uint8{0x0, 0x0, 0x0})
+	n, err = f.asyncRWIoUring(ioringOpWritev, newOp(f, OpWrite, []uint8{0x0, 0x0, 0x0}, f.pos))
 	assert.Equal(t, 0, n)
-	assert.Equal(t, errFailedSq, err)
+	assert.NoError(t, err)
 	assert.Equal(t, 2, c.currentCnt)
 }
 
@@ -126,6 +121,8 @@ func TestFile_fullQueue(t *testing.T) {
 		t.Skip("io_uring doesn't supported")
 	}
 	assert.NoError(t, err)
+	// the completions are reaped by hand, so the queue stays full
+	c.stopReaper()
 
 	f, err := Open("/tmp/io_uring_write", syscall.O_RDWR|syscall.O_CREAT, 0644, ModeAsync)
 	assert.NoError(t, err)
@@ -187,3 +184,462 @@ func TestFile_cap(t *testing.T) {
 	err = f.checkAsyncResult()
 	assert.NoError(t, err)
 }
+
+func TestOp_Cancel(t *testing.T) {
+	prepare(t, asyncIoUring)
+
+	// a read of the empty fifo never completes by itself
+	path := "./opCancel"
+	os.Remove(path)
+	assert.NoError(t, syscall.Mkfifo(path, 0644))
+	defer os.Remove(path)
+	f, err := Open(path, syscall.O_RDWR, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	o, err := f.ReadAtAsync(make([]uint8, 16), 0)
+	assert.NoError(t, err)
+	assert.Error(t, o.Wait(time.Millisecond*50))
+	assert.NoError(t, o.Cancel())
+	assert.NoError(t, o.Wait(time.Second))
+	_, err = o.Result()
+	assert.Equal(t, syscall.ECANCELED, err)
+	assert.NoError(t, o.Cancel())
+
+	ops := make([]*Op, 2)
+	for i := range ops {
+		ops[i], err = f.ReadAtAsync(make([]uint8, 16), 0)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.CancelAll())
+	for _, o := range ops {
+		assert.NoError(t, o.Wait(time.Second))
+		_, err = o.Result()
+		assert.Equal(t, syscall.ECANCELED, err)
+	}
+	assert.Equal(t, uint64(3), c.completedCnt)
+}
+
+func TestFile_ReadContext(t *testing.T) {
+	prepare(t, asyncIoUring)
+
+	path := "./fileReadContext"
+	os.Remove(path)
+	assert.NoError(t, syscall.Mkfifo(path, 0644))
+	defer os.Remove(path)
+	f, err := Open(path, syscall.O_RDWR, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	cx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	buf := make([]uint8, 16)
+	_, err = f.ReadContext(cx, buf)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 0, len(c.operationsFd))
+	// nothing is read, so the position is moved back
+	assert.Equal(t, int64(0), f.Pos())
+
+	_, err = f.ReadContext(cx, buf)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	n, err := f.WriteContext(context.Background(), []uint8("fifo"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	n, err = f.ReadContext(context.Background(), buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "fifo", string(buf[:n]))
+}
+
+func TestFile_SetTimeout(t *testing.T) {
+	prepare(t, asyncIoUring)
+
+	path := "./fileTimeout"
+	os.Remove(path)
+	assert.NoError(t, syscall.Mkfifo(path, 0644))
+	defer os.Remove(path)
+	f, err := Open(path, syscall.O_RDWR, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	f.SetTimeout(time.Millisecond * 20)
+	o, err := f.ReadAtAsync(make([]uint8, 16), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Wait(time.Second))
+	_, err = o.Result()
+	assert.Equal(t, ErrTimeout, err)
+
+	// the timeout is cancelled by the kernel if the operation is completed in time
+	n, err := f.WriteContext(context.Background(), []uint8("fifo"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	o, err = f.ReadAtAsync(make([]uint8, 16), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Wait(time.Second))
+	n, err = o.Result()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	// the operation cancelled explicitly isn't timed out
+	f.SetTimeout(time.Second)
+	o, err = f.ReadAtAsync(make([]uint8, 16), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Cancel())
+	assert.NoError(t, o.Wait(time.Second))
+	_, err = o.Result()
+	assert.Equal(t, syscall.ECANCELED, err)
+	assert.Equal(t, uint64(4), c.completedCnt)
+
+	// the internal timeout operations are reaped too
+	assert.Eventually(t, func() bool {
+		_, _ = WaitAny(1, 0)
+		c.Lock()
+		defer c.Unlock()
+		return len(c.operationsFd) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestCtx_RegisterBufs(t *testing.T) {
+	prepare(t, asyncIoUring)
+
+	path := "./ctxRegisterBufs"
+	f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer func() {
+		f.Close()
+		os.Remove(path)
+	}()
+
+	const sz = 64 * 1024
+	bufs := [][]uint8{AllocBuf(sz), AllocBuf(sz)}
+	if err := RegisterBufs(bufs...); err == syscall.ENOMEM {
+		t.Skip("RLIMIT_MEMLOCK is too low")
+	} else {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, len(c.fixedBufs))
+
+	// a slice inside a registered buffer is written with IORING_OP_WRITE_FIXED
+	for i := range bufs[1] {
+		bufs[1][i] = uint8(i)
+	}
+	var s sqe
+	part := bufs[1][512 : 512+4096]
+	assert.True(t, prepIoUring(newOp(f, OpWrite, part, 0), &s))
+	assert.Equal(t, uint8(ioringOpWriteFixed), s.opcode)
+	idx, _ := c.fixedBufIndex(bufs[1])
+	assert.Equal(t, uint16(idx), s.bufIndex)
+	assert.True(t, prepIoUring(newOp(f, OpWrite, make([]uint8, 16), 0), &s))
+	assert.Equal(t, uint8(ioringOpWritev), s.opcode)
+
+	o, err := f.WriteAtAsync(bufs[1], 0)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Wait(time.Second))
+	n, err := o.Result()
+	assert.NoError(t, err)
+	assert.Equal(t, sz, n)
+
+	o, err = f.ReadAtAsync(bufs[0][:4096], 512)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Wait(time.Second))
+	n, err = o.Result()
+	assert.NoError(t, err)
+	assert.Equal(t, 4096, n)
+	assert.Equal(t, part, bufs[0][:4096])
+
+	ReleaseBuf(bufs[0])
+	assert.Equal(t, 1, len(c.fixedBufs))
+	_, ok := c.fixedBufIndex(bufs[1])
+	assert.True(t, ok)
+	ReleaseBuf(bufs[1])
+	assert.Equal(t, 0, len(c.fixedBufs))
+}
+
+func TestCtx_RegisterBufs_inflight(t *testing.T) {
+	prepare(t, asyncIoUring)
+
+	path := "./ctxRegisterBufsFifo"
+	assert.NoError(t, syscall.Mkfifo(path, 0644))
+	defer os.Remove(path)
+	f, err := Open(path, syscall.O_RDWR, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	const sz = 4096
+	bufs := [][]uint8{AllocBuf(sz), AllocBuf(sz), AllocBuf(sz)}
+	if err := RegisterBufs(bufs[:2]...); err == syscall.ENOMEM {
+		t.Skip("RLIMIT_MEMLOCK is too low")
+	} else {
+		assert.NoError(t, err)
+	}
+	_, ok := c.fixedBufIndex(bufs[1])
+	assert.True(t, ok)
+
+	// nobody writes to the fifo, so the fixed read stays in the ring
+	o, err := f.ReadAtAsync(bufs[1][:1], 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, c.fixedCnt)
+
+	// the indexes would be changed by the registration, so it is postponed and the fixed buffers aren't used meanwhile
+	ReleaseBuf(bufs[0])
+	assert.NoError(t, RegisterBufs(bufs[2]))
+	assert.Equal(t, 2, len(c.fixedBufs))
+	_, ok = c.fixedBufIndex(bufs[1])
+	assert.False(t, ok)
+	var s sqe
+	assert.True(t, prepIoUring(newOp(f, OpWrite, bufs[1], 0), &s))
+	assert.Equal(t, uint8(ioringOpWritev), s.opcode)
+
+	_, err = f.fd.Write([]uint8{7})
+	assert.NoError(t, err)
+	assert.NoError(t, o.Wait(time.Second))
+	n, err := o.Result()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, uint8(7), bufs[1][0])
+
+	// the kernel is done with the read, so the table is replaced
+	assert.Equal(t, 0, c.fixedCnt)
+	assert.Equal(t, 2, len(c.fixedBufs))
+	for _, b := range bufs[1:] {
+		_, ok := c.fixedBufIndex(b)
+		assert.True(t, ok)
+		ReleaseBuf(b)
+	}
+	assert.Equal(t, 0, len(c.fixedBufs))
+}
+
+func TestCtx_RegisterFiles(t *testing.T) {
+	prepare(t, asyncIoUring)
+
+	files := make([]*File, 3)
+	for i := range files {
+		f, err := Open(fmt.Sprintf("./ctxRegisterFiles%d", i), syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+		assert.NoError(t, err)
+		defer os.Remove(f.path)
+		files[i] = f
+	}
+	assert.NoError(t, RegisterFiles(files[:2]...))
+	assert.NoError(t, RegisterFiles(files...))
+	assert.Equal(t, 3, len(c.fixedFiles))
+
+	for i, f := range files {
+		o, err := f.WriteAtAsync([]uint8{uint8(i)}, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, o.Wait(time.Second))
+		n, err := o.Result()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		buf := make([]uint8, 1)
+		o, err = f.ReadAtAsync(buf, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, o.Wait(time.Second))
+		_, err = o.Result()
+		assert.NoError(t, err)
+		assert.Equal(t, uint8(i), buf[0])
+	}
+
+	// the slot of the closed file is reused
+	slot := c.fixedFiles[files[0]]
+	assert.NoError(t, files[0].Close())
+	assert.Equal(t, int32(-1), c.fileSlots[slot])
+	f, err := Open("./ctxRegisterFiles0", syscall.O_RDWR, 0644, ModeAsync)
+	assert.NoError(t, err)
+	assert.NoError(t, RegisterFiles(f))
+	assert.Equal(t, 3, len(c.fixedFiles))
+	assert.NoError(t, f.Close())
+	for _, f := range files[1:] {
+		assert.NoError(t, f.Close())
+	}
+	assert.Equal(t, 0, len(c.fixedFiles))
+}
+
+func Test_copySplice(t *testing.T) {
+	prepare(t, asyncIoUring)
+	if !c.supports(ioringOpSplice) {
+		t.Skip("IORING_OP_SPLICE isn't supported")
+	}
+
+	src, err := Open("./splice_src", syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+	assert.NoError(t, err)
+	dst, err := Open("./splice_dst", syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer func() {
+		src.Close()
+		dst.Close()
+		os.Remove(src.path)
+		os.Remove(dst.path)
+	}()
+
+	// more than the pipe holds
+	data := make([]uint8, 3<<20+100)
+	for i := range data {
+		data[i] = uint8(i * 13)
+	}
+	_, err = src.WriteAt(data, 0)
+	assert.NoError(t, err)
+
+	n, err := copySplice(dst, src, 100, 10, int64(len(data)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)-100), n)
+	out := make([]uint8, n)
+	_, err = dst.ReadAt(out, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, data[100:], out)
+}
+
+func Test_submitIoUring_enterFailed(t *testing.T) {
+	prepare(t, asyncIoUring)
+
+	f, err := Open("./enterFailed", syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer func() {
+		f.Close()
+		os.Remove(f.path)
+	}()
+
+	// io_uring_enter fails after the sqes are flushed
+	ringFd := c.r.ringFd
+	c.r.ringFd = -1
+	b := NewBatch()
+	ops := []*Op{b.Write(f, AllocBuf(512), 0), b.Write(f, AllocBuf(512), 512)}
+	assert.Equal(t, syscall.EBADF, b.Submit())
+	ch := Chain().Write(f, AllocBuf(512), 0).Fsync(f)
+	assert.Equal(t, syscall.EBADF, ch.Submit())
+	c.r.ringFd = ringFd
+
+	// the kernel hasn't consumed the sqes, so the operations are failed once and unregistered
+	for _, o := range append(ops, ch.Ops()...) {
+		assert.True(t, o.Done())
+		_, err := o.Result()
+		assert.Equal(t, syscall.EBADF, err)
+	}
+	assert.Equal(t, 0, len(c.operationsFd))
+	assert.Equal(t, 0, c.currentCnt)
+}
+
+func Test_waitIoUring_noExtArg(t *testing.T) {
+	prepare(t, asyncIoUring)
+
+	f, err := Open("./waitNoExtArg", syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer func() {
+		f.Close()
+		os.Remove(f.path)
+	}()
+
+	// the kernels before 5.11 can't pass the timeout to io_uring_enter
+	features := c.r.features
+	c.r.features &^= ioringFeatExtArg
+	defer func() {
+		c.r.features = features
+	}()
+
+	// the completion ends the wait before the timeout, the timeout is removed then
+	ops := make(chan *Op, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		o, err := f.WriteAtAsync(AllocBuf(512), 0)
+		assert.NoError(t, err)
+		ops <- o
+	}()
+	start := time.Now()
+	assert.NoError(t, c.waitIoUring(1, 5*time.Second))
+	o := <-ops
+	for !o.isDone() {
+		assert.NoError(t, c.waitIoUring(1, 5*time.Second))
+	}
+	assert.True(t, time.Since(start) < time.Second)
+
+	// the removed timeout of the previous wait is reaped first
+	for i := 0; i < 10 && len(c.operationsFd) > 0; i++ {
+		assert.NoError(t, c.waitIoUring(1, time.Second))
+	}
+	// the timeout ends the wait if nothing is completed
+	start = time.Now()
+	assert.NoError(t, c.waitIoUring(1, 20*time.Millisecond))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	assert.Equal(t, 0, len(c.operationsFd))
+	assert.Equal(t, 0, c.currentCnt)
+}
+
+func Test_sqPollUsable(t *testing.T) {
+	assert.True(t, sqPollUsable(&ring{}))
+	assert.True(t, sqPollUsable(&ring{flags: ioringSetupSqPoll, features: ioringFeatSqpollNonfixed | ioringFeatSingleMmap}))
+	// before 5.11 the sqes of the files which aren't registered fail with EBADF
+	assert.False(t, sqPollUsable(&ring{flags: ioringSetupSqPoll, features: ioringFeatSingleMmap}))
+
+	x, err := NewWithOptions(8, sameThreadLim, nil, nil, RingOptions{SQPoll: true})
+	assert.NoError(t, err)
+	defer x.Close()
+	if x.ctx.asyncMode == asyncIoUring {
+		assert.True(t, sqPollUsable(x.ctx.r))
+	}
+}
+
+func TestBarrier_offloaded(t *testing.T) {
+	prepare(t, asyncIoUring)
+
+	f, err := Open("./barrierOffloaded", syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer func() {
+		f.Close()
+		os.Remove(f.path)
+	}()
+	data := make([]uint8, 1<<20)
+	_, err = f.WriteAt(data, 0)
+	assert.NoError(t, err)
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	assert.NoError(t, err)
+	conn := func(fd int) net.Conn {
+		fl := os.NewFile(uintptr(fd), "")
+		defer fl.Close()
+		c, err := net.FileConn(fl)
+		assert.NoError(t, err)
+		return c
+	}
+	w, r := conn(fds[0]), conn(fds[1])
+	defer w.Close()
+	defer r.Close()
+
+	// the send doesn't fit the socket buffer, so it is blocked until the peer reads
+	s, err := f.SendTo(w.(syscall.Conn), 0, int64(len(data)))
+	assert.NoError(t, err)
+	b, err := Barrier()
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, b.Done())
+	go io.Copy(ioutil.Discard, r)
+	assert.NoError(t, b.Wait(time.Second))
+	assert.True(t, s.Done())
+	n, err := s.Result()
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+
+	// the read of the fifo keeps the barrier in the ring, so the following send is deferred
+	path := "./barrierFifo"
+	assert.NoError(t, syscall.Mkfifo(path, 0644))
+	defer os.Remove(path)
+	fifo, err := Open(path, syscall.O_RDWR, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer fifo.Close()
+	rd, err := fifo.ReadAtAsync(make([]uint8, 1), 0)
+	assert.NoError(t, err)
+	b, err = Barrier()
+	assert.NoError(t, err)
+	s, err = f.SendTo(w.(syscall.Conn), 0, 1)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, s.Done())
+
+	_, err = fifo.fd.Write([]uint8{1})
+	assert.NoError(t, err)
+	for _, o := range []*Op{rd, b, s} {
+		assert.NoError(t, o.Wait(time.Second))
+	}
+	n, err = s.Result()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
@@ -7,7 +7,16 @@ import (
 	"unsafe"
 )
 
-func openAsync(path string, flag int, perm os.FileMode) (*os.File, error) {
+// the vectored operations are gathered into one buffer, ReadFileScatter requires unbuffered page-sized I/O
+const nativeVectored = false
+
+type (
+	opCtx struct {
+		ov syscall.Overlapped
+	}
+)
+
+func (c *ctx) openAsync(path string, flag int, perm os.FileMode) (*os.File, error) {
 	p, err := syscall.UTF16PtrFromString(path)
 	if err != nil {
 		return nil, err
@@ -42,16 +51,23 @@ func (f *File) rwAsync(op uint64, data []uint8) (int, error) {
 	var ov *syscall.Overlapped
 
 	switch op {
-	case c.nWriteFile:
+	case f.ctx.nWriteFile:
 		lastOp = OpWrite
 		ov = f.wo
-	case c.nReadFile:
+	case f.ctx.nReadFile:
 		lastOp = OpRead
 		ov = f.ro
 	default:
 		return 0, ErrUnknownOperation
 	}
 
+	f.ctx.Lock()
+	closed := f.ctx.closed
+	f.ctx.Unlock()
+	if closed {
+		return 0, ErrCtxClosed
+	}
+
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
 
@@ -90,9 +106,151 @@ func (f *File) rwAsync(op uint64, data []uint8) (int, error) {
 }
 
 func (f *File) writeAsync(data []uint8) (int, error) {
-	return f.rwAsync(c.nWriteFile, data)
+	return f.rwAsync(f.ctx.nWriteFile, data)
 }
 
 func (f *File) readAsync(data []uint8) (int, error) {
-	return f.rwAsync(c.nReadFile, data)
+	return f.rwAsync(f.ctx.nReadFile, data)
+}
+
+func (f *File) submit(o *Op) error {
+	var nOp uint64
+	switch o.kind {
+	case OpWrite:
+		nOp = f.ctx.nWriteFile
+	case OpRead:
+		nOp = f.ctx.nReadFile
+	case OpSync, OpDatasync:
+		// FlushFileBuffers has no overlapped version
+		return f.ctx.offload(o, func() (int64, error) {
+			return 0, syscall.FlushFileBuffers(syscall.Handle(f.fd.Fd()))
+		})
+	case OpAllocate, OpTruncate, OpOpen, OpClose, OpStat:
+		return f.ctx.offload(o, func() (int64, error) {
+			return f.doSync(o)
+		})
+	default:
+		return ErrUnknownOperation
+	}
+
+	c := f.ctx
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return ErrCtxClosed
+	}
+	c.operationsFd[unsafe.Pointer(&o.ov)] = o
+	o.ov.HEvent = c.takeEvent()
+	c.Unlock()
+
+	o.ov.Offset = uint32(o.off)
+	o.ov.OffsetHigh = uint32(o.off >> 32)
+
+	// the result is always taken by GetOverlappedResult, even if the operation has been completed synchronously
+	var n uint32
+	r1, _, e := syscall.Syscall6(uintptr(nOp), 5, f.fd.Fd(), uintptr(unsafe.Pointer(&o.buf[0])), uintptr(len(o.buf)), uintptr(unsafe.Pointer(&n)), uintptr(unsafe.Pointer(&o.ov)), 0)
+	if r1 == 0 && e != syscall.ERROR_IO_PENDING {
+		c.Lock()
+		delete(c.operationsFd, unsafe.Pointer(&o.ov))
+		c.releaseEvent(o)
+		c.Unlock()
+		if e == syscall.ERROR_HANDLE_EOF {
+			c.completeOps([]*Op{o})
+			return nil
+		}
+		return fmt.Errorf("async error: '%s'", e.Error())
+	}
+	c.armTimers(o)
+	return nil
+}
+
+// submitPath does the operation which isn't bound to a file on a goroutine
+func (c *ctx) submitPath(o *Op) error {
+	return c.offloadPath(o)
+}
+
+// submitBarrier fences the following submissions in userspace
+func (c *ctx) submitBarrier(o *Op) error {
+	return c.fence(o)
+}
+
+// submitChain emulates the linked operations, the next one is submitted when the previous one is completed.
+// It returns the number of the submitted operations, which is zero if it fails
+func (c *ctx) submitChain(ops []*Op, hard bool) (int, error) {
+	if err := c.submitLinked(ops, hard); err != nil {
+		return 0, err
+	}
+	return len(ops), nil
+}
+
+// submitBatch submits the operations one by one.
+// It returns the number of the submitted operations, the rest aren't submitted.
+func (c *ctx) submitBatch(ops []*Op) (int, error) {
+	for i, o := range ops {
+		if err := o.f.submit(o); err != nil {
+			return i, err
+		}
+	}
+	return len(ops), nil
+}
+
+func (c *ctx) cancel(o *Op) error {
+	c.Lock()
+	_, pending := c.operationsFd[unsafe.Pointer(&o.ov)]
+	c.Unlock()
+	if !pending {
+		if o.isDone() {
+			return nil
+		}
+		// the operation is offloaded to a goroutine
+		return ErrNotCancelled
+	}
+
+	// the cancelled operation is reaped by GetOverlappedResult with ERROR_OPERATION_ABORTED
+	r1, _, e := syscall.Syscall(uintptr(c.nCancelIoEx), 2, o.f.fd.Fd(), uintptr(unsafe.Pointer(&o.ov)), 0)
+	if r1 == 0 && e != syscall.ERROR_NOT_FOUND {
+		return e
+	}
+	return nil
+}
+
+// allocateSync extends the file, the allocation modes aren't supported
+func (f *File) allocateSync(off, length int64, mode uint32) error {
+	return f.extend(off, length, mode)
+}
+
+func (o *Op) poll() error {
+	c := o.c
+	c.Lock()
+	_, pending := c.operationsFd[unsafe.Pointer(&o.ov)]
+	c.Unlock()
+	if !pending {
+		return nil
+	}
+
+	var n uint32
+	r1, _, e := syscall.Syscall6(uintptr(c.nGetOverlappedResult), 4, o.f.fd.Fd(), uintptr(unsafe.Pointer(&o.ov)), uintptr(unsafe.Pointer(&n)), 0, 0, 0)
+	if r1 == 0 && (e == syscall.ERROR_IO_PENDING || e == 996) { // WSA_IO_INCOMPLETE(996)
+		return nil
+	}
+
+	c.Lock()
+	if _, ok := c.operationsFd[unsafe.Pointer(&o.ov)]; !ok {
+		// completed by another goroutine
+		c.Unlock()
+		return nil
+	}
+	delete(c.operationsFd, unsafe.Pointer(&o.ov))
+	c.releaseEvent(o)
+	c.Unlock()
+
+	if r1 == 0 && e == syscall.ERROR_OPERATION_ABORTED {
+		o.err = syscall.ECANCELED
+	} else if r1 == 0 && e != syscall.ERROR_HANDLE_EOF {
+		o.err = e
+	} else {
+		o.result = int64(n)
+	}
+	c.completeOps([]*Op{o})
+	return nil
 }
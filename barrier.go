@@ -0,0 +1,138 @@
+package asyncfs
+
+type (
+	// heldStart is a submission queued behind a userspace barrier
+	heldStart struct {
+		ops   []*Op
+		start func()
+		// barrier is set if ops is the next barrier
+		barrier bool
+	}
+)
+
+// Barrier submits an operation which is completed once all the operations submitted before it are completed.
+// The operations submitted after it don't start until then. io_uring drains the ring (IOSQE_IO_DRAIN)
+// and holds the following offloaded operations in userspace; if some offloaded operations are in flight,
+// or on the other backends, all the following submissions are held in userspace.
+// The operations done in place and the legacy Read/Write of the files aren't ordered by the barriers.
+func (c *Ctx) Barrier() (*Op, error) {
+	return c.ctx.barrier()
+}
+
+// Barrier submits a barrier to the default context
+func Barrier() (*Op, error) {
+	return c.barrier()
+}
+
+func (c *ctx) barrier() (*Op, error) {
+	o := newCtxOp(c, OpBarrier)
+	if err := c.submitBarrier(o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// fence emulates the barrier: it is completed when the operations in flight are completed,
+// the following submissions are held until then
+func (c *ctx) fence(o *Op) error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return ErrCtxClosed
+	}
+	if c.fenceOp != nil {
+		c.held = append(c.held, heldStart{ops: []*Op{o}, barrier: true})
+		c.Unlock()
+		return nil
+	}
+	if c.inflight > 0 {
+		c.fenceOp = o
+		c.Unlock()
+		return nil
+	}
+	c.Unlock()
+	c.completeOps([]*Op{o})
+	return nil
+}
+
+// gate counts the operations in flight. If a barrier is pending, the submission is held and true is returned:
+// start is called once the barrier is passed, it must complete the operations it fails to submit
+func (c *ctx) gate(ops []*Op, start func()) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.fenceOp != nil {
+		c.held = append(c.held, heldStart{ops: ops, start: start})
+		return true
+	}
+	c.countInflight(ops)
+	return false
+}
+
+// ungate uncounts the operations which haven't been submitted and completed
+func (c *ctx) ungate(ops []*Op) {
+	c.Lock()
+	defer c.Unlock()
+	for _, o := range ops {
+		if o.inflight {
+			o.inflight = false
+			c.inflight--
+		}
+	}
+}
+
+// countInflight counts the operations, the lock must be held
+func (c *ctx) countInflight(ops []*Op) {
+	for _, o := range ops {
+		if !o.inflight {
+			o.inflight = true
+			c.inflight++
+		}
+	}
+}
+
+// passFences passes the barrier if nothing is in flight, the lock must be held.
+// It returns the barriers to complete and the held submissions to start in order
+func (c *ctx) passFences(force bool) ([]*Op, []func()) {
+	if c.fenceOp == nil || (c.inflight > 0 && !force) {
+		return nil, nil
+	}
+	passed := []*Op{c.fenceOp}
+	c.fenceOp = nil
+	var starts []func()
+	for len(c.held) > 0 {
+		h := c.held[0]
+		if h.barrier {
+			if c.inflight > 0 && !force {
+				c.fenceOp = h.ops[0]
+				c.held = c.held[1:]
+				break
+			}
+			passed = append(passed, h.ops[0])
+		} else {
+			c.countInflight(h.ops)
+			starts = append(starts, h.start)
+		}
+		c.held = c.held[1:]
+	}
+	return passed, starts
+}
+
+// releaseFences passes all the barriers, it is called by close, so the held submissions fail
+func (c *ctx) releaseFences() {
+	c.Lock()
+	passed, starts := c.passFences(true)
+	starts = append(starts, c.undefer()...)
+	c.Unlock()
+	for _, start := range starts {
+		start()
+	}
+	c.completeOps(passed)
+}
+
+// startOrFail submits the held operation and completes it with the error if it fails
+func (f *File) startOrFail(o *Op) {
+	if err := f.submit(o); err != nil {
+		o.err = err
+		f.ctx.completeOps([]*Op{o})
+	}
+}
@@ -0,0 +1,50 @@
+package asyncfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBarrier(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./barrier"
+			f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			const sz = 4096
+			buf := AllocBuf(sz)
+			for i := range buf {
+				buf[i] = uint8(i)
+			}
+			out := AllocBuf(sz)
+			w, err := f.WriteAtAsync(buf, 0)
+			assert.NoError(t, err)
+			b, err := Barrier()
+			assert.NoError(t, err)
+			assert.Nil(t, b.File())
+			r, err := f.ReadAtAsync(out, 0)
+			assert.NoError(t, err)
+			for _, o := range []*Op{w, b, r} {
+				assert.NoError(t, o.Wait(time.Second))
+				_, err := o.Result()
+				assert.NoError(t, err)
+			}
+			// the read has been started after the write
+			assert.Equal(t, buf, out)
+
+			// nothing is in flight
+			b, err = Barrier()
+			assert.NoError(t, err)
+			assert.NoError(t, b.Wait(time.Second))
+		}()
+	}
+}
@@ -0,0 +1,107 @@
+package asyncfs
+
+type (
+	// Batch collects the operations and submits them at once:
+	// the sqes/iocbs are filled under one lock and submitted with one io_uring_enter/io_submit.
+	// The operations are independent, their order of execution isn't defined.
+	Batch struct {
+		ctx *ctx
+		ops []*Op
+		err error
+	}
+)
+
+// NewBatch makes a batch of the context
+func (c *Ctx) NewBatch() *Batch {
+	return &Batch{ctx: c.ctx}
+}
+
+// NewBatch makes a batch of the default context
+func NewBatch() *Batch {
+	return &Batch{ctx: c}
+}
+
+// Read adds a read at the offset
+func (b *Batch) Read(f *File, buf []uint8, off int64) *Op {
+	return b.add(newOp(f, OpRead, buf, off))
+}
+
+// Write adds a write at the offset
+func (b *Batch) Write(f *File, buf []uint8, off int64) *Op {
+	return b.add(newOp(f, OpWrite, buf, off))
+}
+
+// Readv adds a vectored read at the offset
+func (b *Batch) Readv(f *File, bufs [][]uint8, off int64) *Op {
+	return b.add(f.newVecOp(OpRead, bufs, off))
+}
+
+// Writev adds a vectored write at the offset
+func (b *Batch) Writev(f *File, bufs [][]uint8, off int64) *Op {
+	return b.add(f.newVecOp(OpWrite, bufs, off))
+}
+
+// Fsync adds fsync of the file
+func (b *Batch) Fsync(f *File) *Op {
+	return b.add(newOp(f, OpSync, nil, 0))
+}
+
+// Fdatasync adds fdatasync of the file
+func (b *Batch) Fdatasync(f *File) *Op {
+	return b.add(newOp(f, OpDatasync, nil, 0))
+}
+
+// Len returns the number of the operations to submit
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Submit submits the operations, the batch can be reused then.
+// If it fails, the operations that haven't been submitted are completed with the error.
+func (b *Batch) Submit() error {
+	ops, err := b.ops, b.err
+	b.ops, b.err = nil, nil
+	if err != nil {
+		b.fail(ops, err)
+		return err
+	}
+
+	async := make([]*Op, 0, len(ops))
+	for _, o := range ops {
+		if o.immediate() {
+			o.f.doImmediate(o)
+			continue
+		}
+		async = append(async, o)
+	}
+	if len(async) == 0 {
+		return nil
+	}
+	if b.ctx.gate(async, func() { b.submit(async) }) {
+		return nil
+	}
+	return b.submit(async)
+}
+
+func (b *Batch) submit(ops []*Op) error {
+	n, err := b.ctx.submitBatch(ops)
+	if err != nil {
+		b.fail(ops[n:], err)
+	}
+	return err
+}
+
+func (b *Batch) add(o *Op) *Op {
+	if o.f.ctx != b.ctx && b.err == nil {
+		b.err = ErrForeignFile
+	}
+	b.ops = append(b.ops, o)
+	return o
+}
+
+func (b *Batch) fail(ops []*Op, err error) {
+	for _, o := range ops {
+		o.err = err
+	}
+	b.ctx.completeOps(ops)
+}
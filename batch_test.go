@@ -0,0 +1,86 @@
+package asyncfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			files := make([]*File, 0, 2)
+			for _, path := range []string{"./batch1", "./batch2"} {
+				f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+				assert.NoError(t, err)
+				defer func() {
+					f.Close()
+					os.Remove(f.path)
+				}()
+				files = append(files, f)
+			}
+
+			const chunks = 3
+			const sz = 4096
+			b := NewBatch()
+			ops := make([]*Op, 0, 2*chunks+2)
+			for i, f := range files {
+				for j := 0; j < chunks; j++ {
+					buf := AllocBuf(sz)
+					for k := range buf {
+						buf[k] = uint8(i*chunks + j + 1)
+					}
+					ops = append(ops, b.Write(f, buf, int64(j*sz)))
+				}
+			}
+			assert.Equal(t, 2*chunks, b.Len())
+			assert.NoError(t, b.Submit())
+			assert.Equal(t, 0, b.Len())
+			for _, o := range ops {
+				assert.NoError(t, o.Wait(time.Second))
+				n, err := o.Result()
+				assert.NoError(t, err)
+				assert.Equal(t, sz, n)
+			}
+
+			ops = ops[:0]
+			for _, f := range files {
+				ops = append(ops, b.Fsync(f))
+				for j := 0; j < chunks; j++ {
+					ops = append(ops, b.Read(f, AllocBuf(sz), int64(j*sz)))
+				}
+			}
+			// nothing to read
+			ops = append(ops, b.Readv(files[0], [][]uint8{AllocBuf(sz)}, chunks*sz))
+			assert.NoError(t, b.Submit())
+			var v uint8
+			for i, o := range ops {
+				assert.NoError(t, o.Wait(time.Second))
+				n, err := o.Result()
+				switch {
+				case i == len(ops)-1:
+					assert.EqualError(t, err, ErrEOF.Error())
+				case o.kind == OpSync:
+					assert.NoError(t, err)
+				default:
+					v++
+					assert.NoError(t, err)
+					assert.Equal(t, sz, n)
+					assert.Equal(t, v, o.Buffer()[0])
+				}
+			}
+
+			other, err := New(8, sameThreadLim, nil, nil)
+			assert.NoError(t, err)
+			defer other.Close()
+			b = other.NewBatch()
+			o := b.Write(files[0], AllocBuf(sz), 0)
+			assert.EqualError(t, b.Submit(), ErrForeignFile.Error())
+			_, err = o.Result()
+			assert.EqualError(t, err, ErrForeignFile.Error())
+		}()
+	}
+}
@@ -0,0 +1,234 @@
+package asyncfs
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+type (
+	// Blocking is an adapter of the file to the standard io interfaces.
+	// The operations are submitted via the asynchronous path, but the goroutine is parked until they are completed.
+	// The adapter has its own position, the position of the file isn't changed.
+	Blocking struct {
+		f      *File
+		mtx    sync.Mutex
+		pos    int64
+		bounce []uint8
+	}
+)
+
+var (
+	_ io.Reader   = (*Blocking)(nil)
+	_ io.Writer   = (*Blocking)(nil)
+	_ io.ReaderAt = (*Blocking)(nil)
+	_ io.WriterAt = (*Blocking)(nil)
+	_ io.Seeker   = (*Blocking)(nil)
+	_ io.Closer   = (*Blocking)(nil)
+)
+
+var ErrNegativeOffset = errors.New("negative offset")
+
+// Blocking returns the adapter of the file to the standard io interfaces starting at the current position
+func (f *File) Blocking() *Blocking {
+	return &Blocking{
+		f:   f,
+		pos: f.Pos(),
+	}
+}
+
+// File returns the adapted file
+func (b *Blocking) File() *File {
+	return b.f
+}
+
+func (b *Blocking) Read(p []uint8) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := b.readAt(p, b.pos)
+	b.pos += int64(n)
+	if n > 0 {
+		// a short read isn't an error for io.Reader
+		return n, nil
+	}
+	return 0, err
+}
+
+func (b *Blocking) Write(p []uint8) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	n, err := b.writeAt(p, b.pos)
+	b.pos += int64(n)
+	return n, err
+}
+
+func (b *Blocking) ReadAt(p []uint8, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var done int
+	for done < len(p) {
+		n, err := b.readAt(p[done:], off+int64(done))
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+func (b *Blocking) WriteAt(p []uint8, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.writeAt(p, off)
+}
+
+func (b *Blocking) Seek(offset int64, whence int) (int64, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = b.pos + offset
+	case io.SeekEnd:
+		st, err := b.f.fd.Stat()
+		if err != nil {
+			return b.pos, err
+		}
+		pos = st.Size() + offset
+	default:
+		return b.pos, ErrNotImplemented
+	}
+	if pos < 0 {
+		return b.pos, ErrNegativeOffset
+	}
+	b.pos = pos
+	return pos, nil
+}
+
+// Close closes the file
+func (b *Blocking) Close() error {
+	return b.f.Close()
+}
+
+// readAt makes one read, ErrEOF is returned if nothing has been read
+func (b *Blocking) readAt(p []uint8, off int64) (int, error) {
+	align := b.align()
+	if b.aligned(p, off, align) {
+		return b.wait(b.f.ReadAtAsync(p, off))
+	}
+
+	// O_DIRECT: the covering aligned range is read into the bounce buffer
+	start := off &^ int64(align-1)
+	end := (off + int64(len(p)) + int64(align-1)) &^ int64(align-1)
+	buf := b.bounceBuf(int(end - start))
+	n, err := b.wait(b.f.ReadAtAsync(buf, start))
+	if err != nil {
+		return 0, err
+	}
+	skip := int(off - start)
+	if n <= skip {
+		return 0, ErrEOF
+	}
+	return copy(p, buf[skip:n]), nil
+}
+
+// writeAt writes p entirely
+func (b *Blocking) writeAt(p []uint8, off int64) (int, error) {
+	align := b.align()
+	if !b.aligned(p, off, align) {
+		return b.writeUnaligned(p, off, align)
+	}
+	var done int
+	for done < len(p) {
+		n, err := b.wait(b.f.WriteAtAsync(p[done:], off+int64(done)))
+		done += n
+		if err != nil {
+			return done, err
+		}
+		if n == 0 {
+			return done, io.ErrShortWrite
+		}
+	}
+	return done, nil
+}
+
+// writeUnaligned reads, modifies and writes the covering aligned range, then cuts the tail of the last block
+func (b *Blocking) writeUnaligned(p []uint8, off int64, align int) (int, error) {
+	st, err := b.f.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := st.Size()
+
+	start := off &^ int64(align-1)
+	end := (off + int64(len(p)) + int64(align-1)) &^ int64(align-1)
+	buf := b.bounceBuf(int(end - start))
+	for i := range buf {
+		buf[i] = 0
+	}
+	if start < size {
+		if _, err := b.wait(b.f.ReadAtAsync(buf, start)); err != nil && err != ErrEOF {
+			return 0, err
+		}
+	}
+	copy(buf[off-start:], p)
+	if _, err := b.writeAt(buf, start); err != nil {
+		return 0, err
+	}
+	if last := off + int64(len(p)); end > size && last < end {
+		if last < size {
+			last = size
+		}
+		if err := b.f.fd.Truncate(last); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (b *Blocking) wait(o *Op, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	if err := o.Wait(-1); err != nil {
+		return 0, err
+	}
+	return o.Result()
+}
+
+func (b *Blocking) align() int {
+	if b.f.Mode() != ModeAsync || b.f.ctx.align <= 1 {
+		return 1
+	}
+	return b.f.ctx.align
+}
+
+func (b *Blocking) aligned(p []uint8, off int64, align int) bool {
+	if align == 1 || len(p) == 0 {
+		return true
+	}
+	return off%int64(align) == 0 && len(p)%align == 0 && uintptr(unsafe.Pointer(&p[0]))%uintptr(align) == 0
+}
+
+// bounceBuf returns the aligned buffer of sz bytes, it is reused by the next operations
+func (b *Blocking) bounceBuf(sz int) []uint8 {
+	align := b.align()
+	if cap(b.bounce) < sz {
+		raw := make([]uint8, sz+align)
+		shift := (align - int(uintptr(unsafe.Pointer(&raw[0]))%uintptr(align))) % align
+		b.bounce = raw[shift : shift+sz : shift+sz]
+	}
+	return b.bounce[:sz]
+}
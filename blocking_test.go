@@ -0,0 +1,69 @@
+package asyncfs
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestBlocking(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		for _, mode := range []uint8{ModeAsync, ModeSync} {
+			func() {
+				path := "./blocking"
+				f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, mode)
+				assert.NoError(t, err)
+				defer os.Remove(f.path)
+				b := f.Blocking()
+				defer b.Close()
+
+				// the sizes aren't aligned
+				payload := make([]uint8, 10000+333)
+				rand.New(rand.NewSource(1)).Read(payload)
+				n, err := io.Copy(b, bufio.NewReaderSize(bytes.NewReader(payload), 777))
+				assert.NoError(t, err)
+				assert.Equal(t, int64(len(payload)), n)
+				st, err := os.Stat(path)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(len(payload)), st.Size())
+
+				pos, err := b.Seek(0, io.SeekStart)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(0), pos)
+				out, err := ioutil.ReadAll(bufio.NewReaderSize(b, 1000))
+				assert.NoError(t, err)
+				assert.Equal(t, payload, out)
+
+				part := make([]uint8, 100)
+				nn, err := b.ReadAt(part, 5001)
+				assert.NoError(t, err)
+				assert.Equal(t, len(part), nn)
+				assert.Equal(t, payload[5001:5101], part)
+				nn, err = b.ReadAt(part, int64(len(payload)-10))
+				assert.Equal(t, io.EOF, err)
+				assert.Equal(t, 10, nn)
+				assert.Equal(t, payload[len(payload)-10:], part[:10])
+
+				// overwrite in the middle of the blocks
+				nn, err = b.WriteAt([]uint8("hello"), 510)
+				assert.NoError(t, err)
+				assert.Equal(t, 5, nn)
+				copy(payload[510:], "hello")
+				pos, err = b.Seek(-int64(len(payload)), io.SeekEnd)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(0), pos)
+				out, err = ioutil.ReadAll(b)
+				assert.NoError(t, err)
+				assert.Equal(t, payload, out)
+				assert.Equal(t, int64(0), f.Pos())
+			}()
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package asyncfs
+
+import (
+	"sync/atomic"
+	"syscall"
+)
+
+type (
+	// OpChain collects the dependent operations: each of them starts after the previous one is completed.
+	// If an operation fails or transfers less than requested, the rest are completed with ECANCELED,
+	// unless the chain is hard-linked. io_uring links the sqes (IOSQE_IO_LINK/IOSQE_IO_HARDLINK),
+	// the other backends submit the next operation from the completion of the previous one.
+	OpChain struct {
+		ctx  *ctx
+		ops  []*Op
+		hard bool
+		err  error
+	}
+)
+
+// Chain makes a chain of the context
+func (c *Ctx) Chain() *OpChain {
+	return &OpChain{ctx: c.ctx}
+}
+
+// Chain makes a chain of the default context
+func Chain() *OpChain {
+	return &OpChain{ctx: c}
+}
+
+// Read adds a read at the offset
+func (ch *OpChain) Read(f *File, buf []uint8, off int64) *OpChain {
+	return ch.add(newOp(f, OpRead, buf, off))
+}
+
+// Write adds a write at the offset
+func (ch *OpChain) Write(f *File, buf []uint8, off int64) *OpChain {
+	return ch.add(newOp(f, OpWrite, buf, off))
+}
+
+// Readv adds a vectored read at the offset
+func (ch *OpChain) Readv(f *File, bufs [][]uint8, off int64) *OpChain {
+	return ch.add(f.newVecOp(OpRead, bufs, off))
+}
+
+// Writev adds a vectored write at the offset
+func (ch *OpChain) Writev(f *File, bufs [][]uint8, off int64) *OpChain {
+	return ch.add(f.newVecOp(OpWrite, bufs, off))
+}
+
+// Fsync adds fsync of the file
+func (ch *OpChain) Fsync(f *File) *OpChain {
+	return ch.add(newOp(f, OpSync, nil, 0))
+}
+
+// Fdatasync adds fdatasync of the file
+func (ch *OpChain) Fdatasync(f *File) *OpChain {
+	return ch.add(newOp(f, OpDatasync, nil, 0))
+}
+
+// Rename adds the rename of the path, e.g. to publish the file written and flushed by the chain
+func (ch *OpChain) Rename(oldpath, newpath string) *OpChain {
+	ch.ops = append(ch.ops, newPathOp(ch.ctx, OpRename, oldpath, newpath))
+	return ch
+}
+
+// Hard makes the operations run even if the previous ones fail
+func (ch *OpChain) Hard() *OpChain {
+	ch.hard = true
+	return ch
+}
+
+// Ops returns the operations of the chain in order
+func (ch *OpChain) Ops() []*Op {
+	return ch.ops
+}
+
+// Submit submits the chain. If it fails, the operations are completed with the error.
+// The chain can't be reused, the operations are kept for Ops.
+func (ch *OpChain) Submit() error {
+	ops, err := ch.ops, ch.err
+	if len(ops) == 0 {
+		return err
+	}
+	if err != nil {
+		ch.ctx.failChain(ops, err)
+		return err
+	}
+
+	if ch.ctx.gate(ops, func() { ch.submit(ops) }) {
+		return nil
+	}
+	return ch.submit(ops)
+}
+
+func (ch *OpChain) submit(ops []*Op) error {
+	emulate := false
+	for _, o := range ops {
+		emulate = emulate || o.immediate()
+	}
+	var n int
+	var err error
+	if emulate {
+		// the operations done in place can't be linked in the kernel
+		err = ch.ctx.submitLinked(ops, ch.hard)
+	} else {
+		n, err = ch.ctx.submitChain(ops, ch.hard)
+	}
+	if err != nil {
+		// the submitted operations are completed by the kernel
+		ch.ctx.failChain(ops[n:], err)
+	}
+	return err
+}
+
+func (ch *OpChain) add(o *Op) *OpChain {
+	if o.f.ctx != ch.ctx && ch.err == nil {
+		ch.err = ErrForeignFile
+	}
+	ch.ops = append(ch.ops, o)
+	return ch
+}
+
+// submitLinked emulates the linked operations: the next one is started when the previous one is completed.
+// Nothing is started if it fails
+func (c *ctx) submitLinked(ops []*Op, hard bool) error {
+	for i := 0; i+1 < len(ops); i++ {
+		ops[i].next = ops[i+1]
+		ops[i].hardlink = hard
+	}
+	if err := c.startOp(ops[0]); err != nil {
+		for _, o := range ops {
+			o.next = nil
+		}
+		return err
+	}
+	return nil
+}
+
+// startOp submits the operation or does it in place
+func (c *ctx) startOp(o *Op) error {
+	if o.f == nil {
+		return c.submitPath(o)
+	}
+	if o.immediate() {
+		o.f.doImmediate(o)
+		return nil
+	}
+	return o.f.submit(o)
+}
+
+// continueChain starts the operation following the completed one, or fails the rest of the chain
+func (c *ctx) continueChain(o *Op) {
+	next := o.next
+	o.next = nil
+	if !o.hardlink && o.broken() {
+		c.failChain([]*Op{next}, syscall.ECANCELED)
+		return
+	}
+	if err := c.startOp(next); err != nil {
+		c.failChain([]*Op{next}, err)
+	}
+}
+
+// failChain completes the operations and their successors with the error
+func (c *ctx) failChain(ops []*Op, err error) {
+	var failed []*Op
+	for _, o := range ops {
+		for o != nil {
+			next := o.next
+			o.next = nil
+			if !o.isDone() {
+				// it isn't reported as ErrTimeout
+				atomic.StoreInt32(&o.cancelled, 1)
+				o.err = err
+				failed = append(failed, o)
+			}
+			o = next
+		}
+	}
+	c.completeOps(failed)
+}
+
+// broken reports whether the operation breaks the chain: it has failed or transferred less than requested
+func (o *Op) broken() bool {
+	if o.err != nil {
+		return true
+	}
+	return (o.kind == OpRead || o.kind == OpWrite) && o.result < int64(o.size())
+}
@@ -0,0 +1,78 @@
+package asyncfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./chain"
+			f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			const sz = 4096
+			buf := AllocBuf(sz)
+			for i := range buf {
+				buf[i] = uint8(i)
+			}
+			out := AllocBuf(sz)
+			ch := Chain().Write(f, buf, 0).Fdatasync(f).Read(f, out, 0)
+			assert.NoError(t, ch.Submit())
+			for _, o := range ch.Ops() {
+				assert.NoError(t, o.Wait(time.Second))
+				_, err := o.Result()
+				assert.NoError(t, err)
+			}
+			// the read has been started after the write
+			assert.Equal(t, buf, out)
+
+			// the short read breaks the chain
+			ch = Chain().Read(f, out, sz).Write(f, buf, sz).Fsync(f)
+			assert.NoError(t, ch.Submit())
+			ops := ch.Ops()
+			for _, o := range ops {
+				assert.NoError(t, o.Wait(time.Second))
+			}
+			_, err = ops[0].Result()
+			assert.Equal(t, ErrEOF, err)
+			for _, o := range ops[1:] {
+				_, err = o.Result()
+				assert.Equal(t, syscall.ECANCELED, err)
+			}
+
+			// the hard-linked chain goes on
+			ch = Chain().Hard().Read(f, out, sz).Write(f, buf, sz)
+			assert.NoError(t, ch.Submit())
+			ops = ch.Ops()
+			for _, o := range ops {
+				assert.NoError(t, o.Wait(time.Second))
+			}
+			n, err := ops[1].Result()
+			assert.NoError(t, err)
+			assert.Equal(t, sz, n)
+
+			// the file is published after it is flushed
+			published := path + "_published"
+			defer os.Remove(published)
+			ch = Chain().Write(f, buf, 0).Fsync(f).Rename(path, published)
+			assert.NoError(t, ch.Submit())
+			for _, o := range ch.Ops() {
+				assert.NoError(t, o.Wait(time.Second))
+				_, err := o.Result()
+				assert.NoError(t, err)
+			}
+			_, err = os.Stat(published)
+			assert.NoError(t, err)
+		}()
+	}
+}
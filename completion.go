@@ -0,0 +1,185 @@
+package asyncfs
+
+import (
+	"sync"
+)
+
+type (
+	// Completion describes a completed operation
+	Completion struct {
+		Op     *Op
+		File   *File
+		Kind   int
+		Offset int64
+		Buffer []uint8
+		// Buffers are the buffers of a vectored operation
+		Buffers [][]uint8
+		Result  int
+		Err     error
+	}
+
+	// dispatcher delivers the completions to the stream and to the callbacks from its own goroutine,
+	// so neither the reaping nor the ctx lock is held by a slow consumer
+	dispatcher struct {
+		sync.Mutex
+		queue  []dispatchItem
+		wake   chan struct{}
+		out    chan Completion
+		closed bool
+	}
+
+	dispatchItem struct {
+		o      *Op
+		cb     func(Completion)
+		stream bool
+	}
+)
+
+func (o *Op) completion() Completion {
+	n, err := o.Result()
+	return Completion{
+		Op:      o,
+		File:    o.f,
+		Kind:    o.kind,
+		Offset:  o.off,
+		Buffer:  o.Buffer(),
+		Buffers: o.Buffers(),
+		Result:  n,
+		Err:     err,
+	}
+}
+
+// OnComplete sets the callback invoked once the operation is completed.
+// The callbacks and the Completions stream of the context are served by one goroutine in the order of completion,
+// so a callback must not block for long. If the operation has already been completed, fn is invoked anyway.
+func (o *Op) OnComplete(fn func(Completion)) {
+	c := o.c
+	c.Lock()
+	o.onComplete = fn
+	late := o.dispatched && fn != nil && !c.dispatch(dispatchItem{o: o, cb: fn})
+	c.Unlock()
+	if late {
+		// the context is closed, nobody else will call it
+		fn(o.completion())
+	}
+}
+
+// Completions returns the stream of the operations completed by the context after the first call.
+// The channel is closed when the context is closed. It must be drained, otherwise the callbacks are blocked too.
+func (c *Ctx) Completions() <-chan Completion {
+	return c.ctx.completions()
+}
+
+// Completions returns the stream of completions of the default context
+func Completions() <-chan Completion {
+	return c.completions()
+}
+
+func (c *ctx) completions() <-chan Completion {
+	c.Lock()
+	defer c.Unlock()
+	d := c.dispatcherLocked()
+	d.Lock()
+	defer d.Unlock()
+	if d.out == nil {
+		d.out = make(chan Completion)
+		if d.closed {
+			close(d.out)
+		}
+	}
+	return d.out
+}
+
+// dispatcherLocked returns the dispatcher of the context starting it if needed, the ctx lock must be held
+func (c *ctx) dispatcherLocked() *dispatcher {
+	if c.dispatcher == nil {
+		c.dispatcher = &dispatcher{
+			wake:   make(chan struct{}, 1),
+			closed: c.closed,
+		}
+		if !c.closed {
+			go c.dispatcher.run()
+		}
+	}
+	return c.dispatcher
+}
+
+// dispatchOps marks the completed operations and queues those someone is interested in, the ctx lock must be held
+func (c *ctx) dispatchOps(ops []*Op) {
+	stream := false
+	if d := c.dispatcher; d != nil {
+		d.Lock()
+		stream = d.out != nil && !d.closed
+		d.Unlock()
+	}
+	for _, o := range ops {
+		o.dispatched = true
+		if o.onComplete != nil || stream {
+			c.dispatch(dispatchItem{o: o, cb: o.onComplete, stream: stream})
+		}
+	}
+}
+
+// dispatch queues the item, false is returned if the dispatcher is closed
+func (c *ctx) dispatch(it dispatchItem) bool {
+	d := c.dispatcherLocked()
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return false
+	}
+	d.queue = append(d.queue, it)
+	d.Unlock()
+	d.notify()
+	return true
+}
+
+// closeDispatcher makes the dispatcher exit after the queued completions are delivered
+func (c *ctx) closeDispatcher() {
+	c.Lock()
+	d := c.dispatcherLocked()
+	c.Unlock()
+	d.Lock()
+	d.closed = true
+	d.Unlock()
+	d.notify()
+}
+
+func (d *dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dispatcher) run() {
+	for {
+		d.Lock()
+		queue := d.queue
+		d.queue = nil
+		closed := d.closed
+		d.Unlock()
+
+		for _, it := range queue {
+			comp := it.o.completion()
+			if it.cb != nil {
+				it.cb(comp)
+			}
+			if it.stream {
+				d.out <- comp
+			}
+		}
+
+		if len(queue) == 0 {
+			if closed {
+				d.Lock()
+				if d.out != nil {
+					close(d.out)
+				}
+				d.Unlock()
+				return
+			}
+			<-d.wake
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package asyncfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCompletion_stream(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			files := make([]*File, 0, 2)
+			for _, path := range []string{"./completionStream1", "./completionStream2"} {
+				f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+				assert.NoError(t, err)
+				defer func() {
+					f.Close()
+					os.Remove(f.path)
+				}()
+				files = append(files, f)
+			}
+
+			stream := Completions()
+			const sz = 4096
+			ops := make(map[*Op]bool)
+			for i := 0; i < 2; i++ {
+				for _, f := range files {
+					o, err := f.WriteAsync(AllocBuf(sz))
+					assert.NoError(t, err)
+					ops[o] = true
+				}
+			}
+			for o := range ops {
+				assert.NoError(t, o.Wait(time.Second))
+			}
+
+			for n := len(ops); n > 0; n-- {
+				select {
+				case comp := <-stream:
+					assert.True(t, ops[comp.Op])
+					delete(ops, comp.Op)
+					assert.Equal(t, comp.Op.File(), comp.File)
+					assert.Equal(t, OpWrite, comp.Kind)
+					assert.Equal(t, comp.Op.Offset(), comp.Offset)
+					assert.Equal(t, sz, len(comp.Buffer))
+					assert.Equal(t, sz, comp.Result)
+					assert.NoError(t, comp.Err)
+				case <-time.After(time.Second):
+					t.Fatal("too long")
+				}
+			}
+			assert.Equal(t, 0, len(ops))
+
+			assert.NoError(t, c.close())
+			select {
+			case _, ok := <-stream:
+				assert.False(t, ok)
+			case <-time.After(time.Second):
+				t.Fatal("the stream isn't closed")
+			}
+			c = nil
+		}()
+	}
+}
+
+func TestCompletion_callback(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./completionCallback"
+			f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			called := make(chan Completion, 2)
+			o, err := f.WriteAsync(AllocBuf(4096))
+			assert.NoError(t, err)
+			o.OnComplete(func(comp Completion) {
+				called <- comp
+			})
+			assert.NoError(t, o.Wait(time.Second))
+
+			// the operation has already been completed
+			o.OnComplete(func(comp Completion) {
+				called <- comp
+			})
+			for i := 0; i < 2; i++ {
+				select {
+				case comp := <-called:
+					assert.Equal(t, o, comp.Op)
+					assert.Equal(t, 4096, comp.Result)
+				case <-time.After(time.Second):
+					t.Fatal("too long")
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,66 @@
+package asyncfs
+
+import (
+	"io"
+)
+
+// copyChunk is the size of the buffer of the copy through user space
+const copyChunk = 1 << 20
+
+// CopyRange copies n bytes of src at srcOff to dst at dstOff, the goroutine is parked until it is done.
+// The number of the copied bytes is returned, it is less than n if src ends earlier.
+// On linux the range is cloned (FICLONERANGE) if the filesystem supports reflinks, otherwise it is copied by the kernel:
+// with copy_file_range or with IORING_OP_SPLICE through a pipe. The last resort is the read/write through an aligned buffer.
+func CopyRange(dst, src *File, srcOff, dstOff, n int64) (int64, error) {
+	if srcOff < 0 || dstOff < 0 {
+		return 0, ErrNegativeOffset
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+	return copyRange(dst, src, srcOff, dstOff, n)
+}
+
+// chunkBuf allocates the buffer of the copy of n bytes through user space
+func (c *ctx) chunkBuf(n int64) []uint8 {
+	sz := int64(copyChunk)
+	if n < sz {
+		// the buffer is rounded up to the alignment of O_DIRECT
+		align := int64(c.align)
+		if align < 1 {
+			align = 1
+		}
+		sz = (n + align - 1) / align * align
+	}
+	return c.allocBuf(int(sz))
+}
+
+// copyRW copies the range through the buffer of the context of src,
+// the unaligned offsets are handled by the Blocking adapters
+func copyRW(dst, src *File, srcOff, dstOff, n int64) (int64, error) {
+	buf := src.ctx.chunkBuf(n)
+	defer src.ctx.releaseBuf(buf)
+
+	r, w := src.Blocking(), dst.Blocking()
+	var done int64
+	for done < n {
+		p := buf
+		if left := n - done; left < int64(len(p)) {
+			p = p[:left]
+		}
+		k, err := r.ReadAt(p, srcOff+done)
+		if k > 0 {
+			if _, err := w.WriteAt(p[:k], dstOff+done); err != nil {
+				return done, err
+			}
+			done += int64(k)
+		}
+		if err == io.EOF {
+			return done, nil
+		}
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
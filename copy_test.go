@@ -0,0 +1,52 @@
+package asyncfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestCopyRange(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			src, err := Open("./copy_src", syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			dst, err := Open("./copy_dst", syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				src.Close()
+				dst.Close()
+				os.Remove(src.path)
+				os.Remove(dst.path)
+			}()
+
+			const sz = 3*4096 + 100
+			data := make([]uint8, sz)
+			for i := range data {
+				data[i] = uint8(i * 7)
+			}
+			_, err = src.Blocking().WriteAt(data, 0)
+			assert.NoError(t, err)
+
+			check := func(copyFn func(dst, src *File, srcOff, dstOff, n int64) (int64, error), srcOff, dstOff int64) {
+				n, err := copyFn(dst, src, srcOff, dstOff, sz)
+				assert.NoError(t, err)
+				// src ends earlier
+				assert.Equal(t, sz-srcOff, n)
+				out := make([]uint8, n)
+				_, err = dst.Blocking().ReadAt(out, dstOff)
+				assert.NoError(t, err)
+				assert.Equal(t, data[srcOff:], out)
+			}
+			check(CopyRange, 0, 0)
+			check(CopyRange, 100, 4096)
+			check(copyRW, 0, 8192)
+			check(copyRW, 1000, 5)
+
+			_, err = CopyRange(dst, src, -1, 0, sz)
+			assert.Equal(t, ErrNegativeOffset, err)
+		}()
+	}
+}
@@ -0,0 +1,17 @@
+// +build freebsd darwin
+
+package asyncfs
+
+import (
+	"syscall"
+)
+
+// sendTo copies the range through user space, there is no portable splice
+func (f *File) sendTo(rc syscall.RawConn, off, n int64) (int64, error) {
+	return f.sendRW(rc, off, n)
+}
+
+// copyRange copies through user space, there is no portable in-kernel copy
+func copyRange(dst, src *File, srcOff, dstOff, n int64) (int64, error) {
+	return copyRW(dst, src, srcOff, dstOff, n)
+}
@@ -0,0 +1,180 @@
+// +build linux android
+
+package asyncfs
+
+// #include <syscall.h>
+// #include <sys/ioctl.h>
+// #include <linux/fs.h>
+//
+// long copy_file_range_nr() {
+// #if defined(__NR_copy_file_range)
+//     return __NR_copy_file_range;
+// #else
+//     return -1;
+// #endif
+// }
+//
+// unsigned long ficlonerange() {
+// #if defined(FICLONERANGE)
+//     return FICLONERANGE;
+// #else
+//     return 0;
+// #endif
+// }
+import "C"
+
+import (
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+type (
+	// fileCloneRange is struct file_clone_range
+	fileCloneRange struct {
+		srcFd     int64
+		srcOffset uint64
+		srcLength uint64
+		dstOffset uint64
+	}
+)
+
+var (
+	copyFileRangeSys = int(C.copy_file_range_nr())
+	ficloneRange     = uintptr(C.ficlonerange())
+)
+
+// pipeSize is the capacity of the pipe of the splices, the default capacity is used if the kernel refuses it
+const pipeSize = 1 << 20
+
+func copyRange(dst, src *File, srcOff, dstOff, n int64) (int64, error) {
+	if err := cloneRange(dst, src, srcOff, dstOff, n); err == nil {
+		return n, nil
+	}
+	done, err := copyFileRange(dst, src, srcOff, dstOff, n)
+	if !canFallBack(err) {
+		return done, err
+	}
+	k, err := copySplice(dst, src, srcOff+done, dstOff+done, n-done)
+	done += k
+	if !canFallBack(err) {
+		return done, err
+	}
+	k, err = copyRW(dst, src, srcOff+done, dstOff+done, n-done)
+	return done + k, err
+}
+
+// canFallBack reports whether the error means the method can't copy the files, so the next one is tried
+func canFallBack(err error) bool {
+	switch err {
+	case ErrNotSupported, syscall.ENOSYS, syscall.EXDEV, syscall.EINVAL, syscall.EOPNOTSUPP, syscall.EBADF:
+		return true
+	default:
+		return false
+	}
+}
+
+// cloneRange shares the extents of src with dst, the filesystem must support reflinks
+func cloneRange(dst, src *File, srcOff, dstOff, n int64) error {
+	if ficloneRange == 0 {
+		return ErrNotSupported
+	}
+	arg := fileCloneRange{
+		srcFd:     int64(src.fd.Fd()),
+		srcOffset: uint64(srcOff),
+		srcLength: uint64(n),
+		dstOffset: uint64(dstOff),
+	}
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, dst.fd.Fd(), ficloneRange, uintptr(unsafe.Pointer(&arg)))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// copyFileRange copies the range with copy_file_range, the kernel may do it without moving the data
+func copyFileRange(dst, src *File, srcOff, dstOff, n int64) (int64, error) {
+	if copyFileRangeSys <= 0 {
+		return 0, ErrNotSupported
+	}
+	var done int64
+	for done < n {
+		offIn, offOut := srcOff+done, dstOff+done
+		r1, _, e := syscall.Syscall6(uintptr(copyFileRangeSys), src.fd.Fd(), uintptr(unsafe.Pointer(&offIn)),
+			dst.fd.Fd(), uintptr(unsafe.Pointer(&offOut)), uintptr(n-done), 0)
+		if e == syscall.EINTR {
+			continue
+		}
+		if e != 0 {
+			return done, e
+		}
+		if r1 == 0 {
+			// the end of src
+			return done, nil
+		}
+		done += int64(r1)
+	}
+	return done, nil
+}
+
+// newSplicePipe makes the pipe of the splices, its capacity is returned
+func newSplicePipe() ([2]int, int64, error) {
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		return p, 0, err
+	}
+	r1, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(p[1]), syscall.F_SETPIPE_SZ, pipeSize)
+	if e != 0 {
+		// the default capacity of the pipe
+		return p, 1 << 16, nil
+	}
+	return p, int64(r1), nil
+}
+
+func closePipe(p [2]int) {
+	syscall.Close(p[0])
+	syscall.Close(p[1])
+}
+
+// copySplice moves the range through a pipe with IORING_OP_SPLICE, neither the data is copied to user space
+// nor a thread is blocked
+func copySplice(dst, src *File, srcOff, dstOff, n int64) (int64, error) {
+	c := src.ctx
+	if c.asyncMode != asyncIoUring || c.iopoll || !c.supports(ioringOpSplice) {
+		return 0, ErrNotSupported
+	}
+	p, chunk, err := newSplicePipe()
+	if err != nil {
+		return 0, err
+	}
+	defer closePipe(p)
+
+	var done int64
+	for done < n {
+		k := n - done
+		if k > chunk {
+			k = chunk
+		}
+		k, err := c.splice(int(src.fd.Fd()), srcOff+done, p[1], -1, k)
+		if err != nil {
+			return done, err
+		}
+		if k == 0 {
+			// the end of src
+			return done, nil
+		}
+		for k > 0 {
+			// the pipe is drained before the next chunk, otherwise the splice into it would wait for the room
+			m, err := c.splice(p[0], -1, int(dst.fd.Fd()), dstOff+done, k)
+			if err != nil {
+				return done, err
+			}
+			if m == 0 {
+				return done, io.ErrShortWrite
+			}
+			done += m
+			k -= m
+		}
+	}
+	return done, nil
+}
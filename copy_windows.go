@@ -0,0 +1,17 @@
+// +build windows
+
+package asyncfs
+
+import (
+	"syscall"
+)
+
+// sendTo isn't supported, the sockets are overlapped
+func (f *File) sendTo(rc syscall.RawConn, off, n int64) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+// copyRange copies through user space
+func copyRange(dst, src *File, srcOff, dstOff, n int64) (int64, error) {
+	return copyRW(dst, src, srcOff, dstOff, n)
+}
@@ -1,12 +1,19 @@
 package asyncfs
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 	"unsafe"
 )
 
 type (
 	asyncOpState struct {
+		op       *Op
 		data     []uint8
 		result   int64
 		lastCap  int
@@ -29,32 +36,217 @@ type (
 		align       int
 		sz          int
 		currentCnt  int
+		closed      bool
+		// reaping is set while a goroutine reaps the completions, the waiters don't go to the kernel then
+		reaping bool
+		// waiter is the slot of the goroutine that waits in the kernel, reaped is closed when operations are completed
+		waiter       chan struct{}
+		reaped       chan struct{}
+		completedCnt uint64
+		dispatcher   *dispatcher
+		// offloaded counts the operations done by the goroutines, close waits for them
+		offloaded sync.WaitGroup
+		opts      RingOptions
+		// inflight counts the submitted operations, fenceOp is the barrier waiting for them in userspace
+		// and held are the submissions after it
+		inflight int
+		fenceOp  *Op
+		held     []heldStart
+		// offloading are the offloaded operations in flight, drains counts the barriers draining the ring
+		// and deferred are the offloaded operations submitted after them
+		offloading map[*Op]struct{}
+		drains     int
+		deferred   []func()
+		// pathWorkers limits the offloaded operations on the paths
+		pathWorkers chan struct{}
 		sync.Mutex
 	}
+
+	// RingOptions are the io_uring settings of a context, the other backends ignore them
+	RingOptions struct {
+		// SQPoll makes a kernel thread poll the submission queue (IORING_SETUP_SQPOLL),
+		// so the submissions don't need a syscall while the thread is awake.
+		// The ring is set up without it if the kernel refuses (the older kernels require CAP_SYS_ADMIN)
+		SQPoll bool
+		// SQThreadIdle is the time after which the idle kernel thread sleeps, the kernel default is used if it is zero
+		SQThreadIdle time.Duration
+		// SQThreadCPU is the CPU the kernel thread is bound to if SQAffinity is set
+		SQThreadCPU int
+		SQAffinity  bool
+		// IOPoll makes the kernel poll the device for the completions instead of waiting for the interrupts (IORING_SETUP_IOPOLL).
+		// The files are opened with O_DIRECT and the buffers must be aligned like with aio.
+		// The operations of the files on the devices which can't be polled are done by the goroutines
+		IOPoll bool
+	}
+
+	// Ctx is an independent asynchronous I/O context: it owns its own queue
+	// (io_uring ring, aio context, ...), buffer allocator and thread limit.
+	// Files are bound to the Ctx that opened them.
+	Ctx struct {
+		ctx *ctx
+	}
+
+	// PendingOpsError is returned by Ctx.Close when some files still had operations in flight.
+	// The operations have been completed (or cancelled) before the context was destroyed.
+	PendingOpsError struct {
+		Files []*File
+		// Ops are the operations which were neither completed nor cancelled in time. The ones in the kernel are failed
+		// with ErrCtxClosed, the ones done by the goroutines are completed once the goroutines return.
+		// The kernel may still use the buffers of the failed ones (aio can't cancel the reads and writes of the regular files),
+		// so the buffers are kept from the garbage collector and must never be reused or released by the caller
+		Ops []*Op
+	}
 )
 
 const (
-	OpUnknown = 0x0
-	OpRead    = 0x1
-	OpWrite   = 0x2
+	OpUnknown  = 0x0
+	OpRead     = 0x1
+	OpWrite    = 0x2
+	OpSync     = 0x3
+	OpDatasync = 0x4
+	OpBarrier  = 0x5
+	OpAllocate = 0x6
+	OpTruncate = 0x7
+	OpOpen     = 0x8
+	OpClose    = 0x9
+	OpStat     = 0xa
+	OpRename   = 0xb
+	OpUnlink   = 0xc
+	OpMkdir    = 0xd
+	OpLink     = 0xe
+	OpSymlink  = 0xf
+	OpSend     = 0x10
+
+	// opCancel is the internal operation cancelling another one
+	opCancel = 0x100
+	// opLinkTimeout is the internal timeout linked to an operation
+	opLinkTimeout = 0x101
+	// opSplice is the internal move of the data between the descriptors
+	opSplice = 0x102
+	// opTimeout is the internal timeout bounding a wait in the kernel
+	opTimeout = 0x103
 )
 
+// waitSlice bounds a single wait in the kernel
+const waitSlice = 50 * time.Millisecond
+
+// abandoned keeps the operations failed by close while the kernel may still use them,
+// so the garbage collector never frees their buffers
+var abandoned struct {
+	sync.Mutex
+	ops []*Op
+}
+
+// abandon keeps the operations referenced until the process exits
+func abandon(ops []*Op) {
+	if len(ops) == 0 {
+		return
+	}
+	abandoned.Lock()
+	abandoned.ops = append(abandoned.ops, ops...)
+	abandoned.Unlock()
+}
+
+// closeGrace is how long close waits for the operations in flight before cancelling them
+var closeGrace = time.Second
+
+// maxPathWorkers bounds the goroutines blocked in the offloaded operations on the paths
+const maxPathWorkers = 16
+
+// c is the default context used by the package-level functions
 var c *ctx
 
+// New makes an independent context.
+// sz - asynchronous operations queue size;
+// sameThreadLim - the byte limit for synchronous I/O that determines whether to switch to a new OS thread;
+// bufPoller, bufReleaser - memory operations for the buffers returned by AllocBuf, can be nil.
+func New(sz int, sameThreadLim int, bufPoller func(int) []uint8, bufReleaser func([]uint8)) (*Ctx, error) {
+	return NewWithOptions(sz, sameThreadLim, bufPoller, bufReleaser, RingOptions{})
+}
+
+// NewWithOptions makes an independent context like New does, the ring is set up with opts
+func NewWithOptions(sz int, sameThreadLim int, bufPoller func(int) []uint8, bufReleaser func([]uint8), opts RingOptions) (*Ctx, error) {
+	x := new(ctx)
+	x.opts = opts
+	if err := x.initCtx(sz); err != nil {
+		return nil, err
+	}
+	x.sz = sz
+	x.newThread = func(sz int) bool {
+		return sz > sameThreadLim
+	}
+	x.bufPoller = bufPoller
+	x.bufReleaser = bufReleaser
+	return &Ctx{ctx: x}, nil
+}
+
+// NewCtx initializes the default context used by the package-level functions.
+// The previous default context is closed, so the files opened by it can't be used anymore:
+// their operations fail with ErrCtxClosed and they must be opened again.
 func NewCtx(sz int, sameThreadLim int, bufPoller func(int) []uint8, bufReleaser func([]uint8)) error {
-	c = new(ctx)
-	if err := c.initCtx(sz); err != nil {
+	x, err := New(sz, sameThreadLim, bufPoller, bufReleaser)
+	if err != nil {
 		return err
 	}
-	c.sz = sz
-	c.newThread = func(sz int) bool {
-		return sz > sameThreadLim
+	if c != nil {
+		_ = c.close()
 	}
-	c.bufPoller = bufPoller
-	c.bufReleaser = bufReleaser
+	c = x.ctx
 	return nil
 }
 
+// Close refuses new submissions, waits for the operations in flight and releases the kernel resources.
+// On linux and windows the operations which aren't completed in a second are cancelled, the ones which can't be cancelled
+// either are failed with ErrCtxClosed, so one stuck operation doesn't block Close forever.
+// The operations done by the goroutines are waited for a second as well, then SendTo is interrupted
+// and the ones still running a second later are returned in *PendingOpsError without waiting for them.
+// If some files still had pending operations, *PendingOpsError is returned.
+func (c *Ctx) Close() error {
+	return c.ctx.close()
+}
+
+func (c *Ctx) Open(path string, mode int, perm os.FileMode, openMode uint8) (*File, error) {
+	return c.ctx.open(path, mode, perm, openMode)
+}
+
+func (c *Ctx) Create(path string, fsMode uint8) (*File, error) {
+	return c.Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0666, fsMode)
+}
+
+func (c *Ctx) AllocBuf(sz int) []uint8 {
+	return c.ctx.allocBuf(sz)
+}
+
+func (c *Ctx) ReleaseBuf(b []uint8) {
+	c.ctx.releaseBuf(b)
+}
+
+// RegisterBufs registers the buffers with the ring, the reads and the writes of the slices lying inside them
+// are submitted as IORING_OP_READ_FIXED/IORING_OP_WRITE_FIXED, so the kernel doesn't pin the pages every operation.
+// The buffers are usually allocated by AllocBuf, ReleaseBuf unregisters them. The buffers must not overlap.
+// While the fixed operations are in flight the registration is postponed until they are completed.
+// ErrNotSupported is returned by the backends other than io_uring.
+func (c *Ctx) RegisterBufs(bufs ...[]uint8) error {
+	return c.ctx.registerBufs(bufs)
+}
+
+// RegisterFiles registers the files with the ring, their operations are submitted with IOSQE_FIXED_FILE,
+// so the kernel doesn't look up the descriptor every operation. The files are unregistered when they are closed.
+// ErrNotSupported is returned by the backends other than io_uring.
+func (c *Ctx) RegisterFiles(files ...*File) error {
+	return c.ctx.registerFiles(files)
+}
+
+func (c *Ctx) Align() int {
+	return c.ctx.align
+}
+
+// WaitAny waits until at least min operations of the context are completed or the timeout expires.
+// A negative timeout waits indefinitely. It returns the number of the completed operations.
+func (c *Ctx) WaitAny(min int, timeout time.Duration) (int, error) {
+	return c.ctx.waitAny(min, timeout)
+}
+
 func AllocBuf(sz int) []uint8 {
 	return c.allocBuf(sz)
 }
@@ -63,6 +255,308 @@ func ReleaseBuf(b []uint8) {
 	c.releaseBuf(b)
 }
 
+// RegisterBufs registers the buffers with the ring of the default context
+func RegisterBufs(bufs ...[]uint8) error {
+	return c.registerBufs(bufs)
+}
+
+// RegisterFiles registers the files with the ring of the default context
+func RegisterFiles(files ...*File) error {
+	return c.registerFiles(files)
+}
+
 func Align() int {
 	return c.align
 }
+
+// WaitAny waits for the operations of the default context.
+func WaitAny(min int, timeout time.Duration) (int, error) {
+	return c.waitAny(min, timeout)
+}
+
+// Close closes the default context.
+func Close() error {
+	return c.close()
+}
+
+func (e *PendingOpsError) Error() string {
+	paths := make([]string, 0, len(e.Files))
+	for _, f := range e.Files {
+		paths = append(paths, f.path)
+	}
+	msg := fmt.Sprintf("ctx closed with pending operations on %d file(s): %s", len(e.Files), strings.Join(paths, ", "))
+	if len(e.Ops) > 0 {
+		msg += fmt.Sprintf("; %d operation(s) weren't completed in time", len(e.Ops))
+	}
+	return msg
+}
+
+func pendingOpsError(files []*File, stuck []*Op) error {
+	if len(files) == 0 && len(stuck) == 0 {
+		return nil
+	}
+	uniq := make([]*File, 0, len(files))
+	seen := make(map[*File]struct{}, len(files))
+	for _, f := range files {
+		if _, ok := seen[f]; ok || f == nil {
+			// the barriers aren't bound to the files
+			continue
+		}
+		seen[f] = struct{}{}
+		uniq = append(uniq, f)
+	}
+	if len(uniq) == 0 && len(stuck) == 0 {
+		return nil
+	}
+	return &PendingOpsError{Files: uniq, Ops: stuck}
+}
+
+// offloadPath does the operation on the path on a goroutine,
+// at most maxPathWorkers of them are blocked in the syscalls at once, so a burst doesn't make a thread per operation
+func (c *ctx) offloadPath(o *Op) error {
+	c.Lock()
+	if c.pathWorkers == nil {
+		c.pathWorkers = make(chan struct{}, maxPathWorkers)
+	}
+	workers := c.pathWorkers
+	c.Unlock()
+	return c.offload(o, func() (int64, error) {
+		workers <- struct{}{}
+		defer func() {
+			<-workers
+		}()
+		return o.doPath()
+	})
+}
+
+// offload runs the operation on its own goroutine, it is used when the kernel can't do it asynchronously
+func (c *ctx) offload(o *Op, fn func() (int64, error)) error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return ErrCtxClosed
+	}
+	c.offloaded.Add(1)
+	if c.offloading == nil {
+		c.offloading = make(map[*Op]struct{})
+	}
+	c.offloading[o] = struct{}{}
+	run := func() {
+		go func() {
+			defer c.offloaded.Done()
+			o.result, o.err = fn()
+			c.Lock()
+			delete(c.offloading, o)
+			c.Unlock()
+			c.completeOps([]*Op{o})
+		}()
+	}
+	if c.drains > 0 {
+		// the ring doesn't order the goroutines, so the operation waits for the barriers
+		c.deferred = append(c.deferred, run)
+		c.Unlock()
+		return nil
+	}
+	c.Unlock()
+	run()
+	return nil
+}
+
+// abortOffloaded interrupts the offloaded operation, false is returned if it isn't running or can't be stopped
+func (c *ctx) abortOffloaded(o *Op) bool {
+	c.Lock()
+	_, running := c.offloading[o]
+	abort := o.abort
+	c.Unlock()
+	if !running || abort == nil {
+		return false
+	}
+	abort()
+	return true
+}
+
+// waitOffloaded waits closeGrace for the offloaded operations, then interrupts the ones which can be stopped
+// and waits closeGrace more. The user operations still running are returned, they are completed once their goroutines return
+func (c *ctx) waitOffloaded() []*Op {
+	done := make(chan struct{})
+	go func() {
+		c.offloaded.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(closeGrace):
+	}
+
+	c.Lock()
+	running := make([]*Op, 0, len(c.offloading))
+	for o := range c.offloading {
+		running = append(running, o)
+	}
+	c.Unlock()
+	for _, o := range running {
+		c.abortOffloaded(o)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(closeGrace):
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	stuck := make([]*Op, 0, len(c.offloading))
+	for o := range c.offloading {
+		if !o.internal {
+			stuck = append(stuck, o)
+		}
+	}
+	return stuck
+}
+
+// completeOps publishes the results of the operations and wakes up the waiters
+func (c *ctx) completeOps(ops []*Op) {
+	if len(ops) == 0 {
+		return
+	}
+	public := make([]*Op, 0, len(ops))
+	for _, o := range ops {
+		o.complete()
+		if !o.internal {
+			public = append(public, o)
+		}
+	}
+	c.Lock()
+	for _, o := range ops {
+		if o.timer != nil {
+			o.timer.Stop()
+			o.timer = nil
+		}
+		if o.inflight {
+			o.inflight = false
+			c.inflight--
+		}
+		if o.drain {
+			o.drain = false
+			c.drains--
+		}
+	}
+	passed, starts := c.passFences(false)
+	starts = append(starts, c.undefer()...)
+	// the internal operations aren't visible to the waiters and the stream
+	c.completedCnt += uint64(len(public))
+	c.dispatchOps(public)
+	if c.reaped != nil {
+		close(c.reaped)
+		c.reaped = nil
+	}
+	c.Unlock()
+
+	for _, o := range ops {
+		if o.next != nil {
+			c.continueChain(o)
+		}
+	}
+	for _, start := range starts {
+		start()
+	}
+	c.completeOps(passed)
+}
+
+// undefer returns the deferred offloaded operations once no barrier drains the ring, the lock must be held
+func (c *ctx) undefer() []func() {
+	if c.drains > 0 && !c.closed {
+		return nil
+	}
+	deferred := c.deferred
+	c.deferred = nil
+	return deferred
+}
+
+func (c *ctx) waitAny(min int, timeout time.Duration) (int, error) {
+	if min < 1 {
+		min = 1
+	}
+	c.Lock()
+	start := c.completedCnt
+	c.Unlock()
+	cnt := func() int {
+		c.Lock()
+		defer c.Unlock()
+		return int(c.completedCnt - start)
+	}
+	err := c.waitFor(context.Background(), func() bool {
+		return cnt() >= min
+	}, timeout)
+	return cnt(), err
+}
+
+// waitFor waits until cond is true, the timeout expires or cx is done.
+// Only one goroutine waits in the kernel and reaps the completions, the others are woken up by it.
+func (c *ctx) waitFor(cx context.Context, cond func() bool, timeout time.Duration) error {
+	var deadline time.Time
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	for {
+		c.Lock()
+		if c.waiter == nil {
+			c.waiter = make(chan struct{}, 1)
+		}
+		if c.reaped == nil {
+			c.reaped = make(chan struct{})
+		}
+		waiter, reaped := c.waiter, c.reaped
+		if c.reaping {
+			// a nil channel is never ready, so the completions are awaited from the reaper only
+			waiter = nil
+		}
+		c.Unlock()
+
+		if cond() {
+			return nil
+		}
+
+		select {
+		case waiter <- struct{}{}:
+			// the completion may be reaped by a poller right before the kernel wait, so the wait is sliced
+			d := waitSlice
+			if timeout >= 0 {
+				if left := time.Until(deadline); left < d {
+					d = left
+				}
+				if d < 0 {
+					d = 0
+				}
+			}
+			err := c.wait(1, d)
+			<-waiter
+			if err != nil {
+				return err
+			}
+			if timeout >= 0 && !time.Now().Before(deadline) && !cond() {
+				return ErrNotCompleted
+			}
+			if err := cx.Err(); err != nil && !cond() {
+				return err
+			}
+		case <-reaped:
+		case <-cx.Done():
+			if cond() {
+				return nil
+			}
+			return cx.Err()
+		case <-expired:
+			if cond() {
+				return nil
+			}
+			return ErrNotCompleted
+		}
+	}
+}
@@ -3,27 +3,94 @@
 package asyncfs
 
 import (
+	"time"
 	"unsafe"
 )
 
 type (
-	opCap struct {
-		f    *File
-		data int64
-	}
-
 	ctx struct {
 		baseCtx
-		operationsFd map[unsafe.Pointer]opCap
+		operationsFd map[unsafe.Pointer]*Op
 	}
 )
 
 func (c *ctx) initCtx(sz int) error {
 	c.asyncMode = asyncAio
-	c.operationsFd = make(map[unsafe.Pointer]opCap, sz)
+	c.operationsFd = make(map[unsafe.Pointer]*Op, sz)
 	return nil
 }
 
+func (c *ctx) close() error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return ErrCtxClosed
+	}
+	c.closed = true
+	files := make([]*File, 0, len(c.operationsFd))
+	for _, o := range c.operationsFd {
+		files = append(files, o.f)
+	}
+	c.Unlock()
+	// the held submissions fail and the barriers are completed
+	c.releaseFences()
+	// the stream is closed after the drain
+	defer c.closeDispatcher()
+	offloaded := c.waitOffloaded()
+
+	for {
+		if err := fillStatesAio(c); err != nil {
+			return err
+		}
+		c.Lock()
+		pending := len(c.operationsFd)
+		c.Unlock()
+		if pending == 0 {
+			break
+		}
+		if err := suspendAio(c, waitSlice); err != nil {
+			return err
+		}
+	}
+	for _, o := range offloaded {
+		files = append(files, o.f)
+	}
+	return pendingOpsError(files, offloaded)
+}
+
+// wait blocks in aio_suspend until something is completed or the timeout expires
+func (c *ctx) wait(min int, timeout time.Duration) error {
+	if err := fillStatesAio(c); err != nil {
+		return err
+	}
+	c.Lock()
+	reaped := c.reaped
+	pending := len(c.operationsFd)
+	c.Unlock()
+	if reaped == nil || timeout == 0 {
+		return nil
+	}
+
+	if pending == 0 {
+		// nothing is in the kernel, the operations done by the goroutines close reaped
+		var expired <-chan time.Time
+		if timeout > 0 {
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			expired = t.C
+		}
+		select {
+		case <-reaped:
+		case <-expired:
+		}
+		return nil
+	}
+	if err := suspendAio(c, timeout); err != nil {
+		return err
+	}
+	return fillStatesAio(c)
+}
+
 func (c *ctx) allocBuf(sz int) []uint8 {
 	var buf []uint8
 	if c.bufPoller != nil {
@@ -48,6 +115,14 @@ func (c *ctx) releaseBuf(b []uint8) {
 	}
 }
 
+func (c *ctx) registerBufs(bufs [][]uint8) error {
+	return ErrNotSupported
+}
+
+func (c *ctx) registerFiles(files []*File) error {
+	return ErrNotSupported
+}
+
 func (c *ctx) busy() bool {
 	return false
 }
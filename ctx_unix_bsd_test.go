@@ -15,6 +15,10 @@ func steps() []int {
 func prepare(t *testing.T, mode int) {
 	var sz int
 
+	if c != nil {
+		_ = c.close()
+	}
+
 	if mode == 0 { // windows/bsd
 		sz = 8
 		err := NewCtx(sz, sameThreadLim, nil, nil)
@@ -25,7 +29,7 @@ func prepare(t *testing.T, mode int) {
 	sz = 8
 	c = new(ctx)
 	c.asyncMode = asyncAio
-	c.operationsFd = make(map[unsafe.Pointer]opCap, sz)
+	c.operationsFd = make(map[unsafe.Pointer]*Op, sz)
 	c.sz = sz
 	c.currentCnt = 0
 	c.align = 512
@@ -3,8 +3,10 @@
 package asyncfs
 
 import (
+	"fmt"
+	"os"
 	"reflect"
-	"sync"
+	"sort"
 	"syscall"
 	"unsafe"
 )
@@ -12,29 +14,107 @@ import (
 type (
 	ctx struct {
 		baseCtx
-		operationsFd        map[unsafe.Pointer]*File
-		alignedBuffers      map[unsafe.Pointer]slice
-		aio                 uint64
-		r                   *ring
-		ioUringUserDataPool sync.Pool
+		operationsFd   map[unsafe.Pointer]*Op
+		alignedBuffers map[unsafe.Pointer]slice
+		aio            uint64
+		r              *ring
+		// efd is signaled by the kernel on completions, notify is the same eventfd parked in the netpoller by the reaper
+		efd        int
+		notify     *os.File
+		reaperDone chan struct{}
+		// fixedBufs are the buffers registered with the ring sorted by the address, the index is the position.
+		// It is guarded by the lock
+		fixedBufs [][]uint8
+		// nextBufs replaces fixedBufs once fixedCnt, the number of the fixed operations from the submission
+		// to the completion, drops to zero, so the indexes of their sqes stay valid until the kernel is done with them.
+		// The registered buffers aren't used while bufsChanged is set. They are guarded by the lock
+		nextBufs    [][]uint8
+		bufsChanged bool
+		fixedCnt    int
+		// fixedFiles are the slots of the registered files, fileSlots is the registered table (-1 is a free slot).
+		// They are guarded by the lock
+		fixedFiles map[*File]int
+		fileSlots  []int32
+		// iopoll is set if the ring polls the device for the completions
+		iopoll bool
+		// opcodes are the io_uring opcodes supported by the kernel
+		opcodes []bool
 	}
 )
 
 func (c *ctx) initCtx(sz int) error {
-	c.operationsFd = make(map[unsafe.Pointer]*File, sz)
+	c.operationsFd = make(map[unsafe.Pointer]*Op, sz)
 
 	// check io_uring
-	if err := c.initIoUring(sz); err == nil {
-		c.ioUringUserDataPool = sync.Pool{
-			New: func() interface{} {
-				return &cqUserData{}
-			},
+	if err := c.initIoUring(sz); err != nil {
+		// use aio
+		if err := c.initAio(sz); err != nil {
+			return err
 		}
+	}
+
+	if c.iopoll {
+		// the completions of the polled ring are posted only while somebody polls, so the eventfd isn't signaled by itself
 		return nil
 	}
+	// without the reaper the waits block in the kernel
+	_ = c.initReaper()
+	return nil
+}
 
-	// use aio
-	return c.initAio(sz)
+// initReaper starts the goroutine that drains the completions when the eventfd is signaled.
+// The eventfd is non-blocking, so the reaper and the waiters are parked by the netpoller and don't hold OS threads.
+func (c *ctx) initReaper() error {
+	r1, _, e := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if e != 0 {
+		return e
+	}
+	efd := int(r1)
+	if c.asyncMode == asyncIoUring {
+		if err := registerEventFd(c.r, efd); err != nil {
+			_ = syscall.Close(efd)
+			return err
+		}
+	}
+
+	c.efd = efd
+	c.notify = os.NewFile(uintptr(efd), "asyncfs-eventfd")
+	c.reaperDone = make(chan struct{})
+	c.reaping = true
+	go c.reap()
+	return nil
+}
+
+func (c *ctx) reap() {
+	defer func() {
+		c.Lock()
+		c.reaping = false
+		// the waiters have to fall back to the kernel waits
+		if c.reaped != nil {
+			close(c.reaped)
+			c.reaped = nil
+		}
+		c.Unlock()
+		close(c.reaperDone)
+	}()
+
+	cnt := make([]uint8, 8)
+	for {
+		if _, err := c.notify.Read(cnt); err != nil {
+			return
+		}
+		if err := c.fillStates(); err != nil && err != syscall.EINTR {
+			return
+		}
+	}
+}
+
+func (c *ctx) stopReaper() {
+	if c.notify == nil {
+		return
+	}
+	_ = c.notify.Close()
+	<-c.reaperDone
 }
 
 func (c *ctx) initIoUring(sz int) error {
@@ -42,11 +122,33 @@ func (c *ctx) initIoUring(sz int) error {
 		return ErrNotSupported
 	}
 	var r ring
-	if err := setup(uint32(sz), &r, 0); err != nil {
-		return err
+	opts := c.opts
+	err := setupOptions(uint32(sz), &r, opts)
+	if err == nil && !sqPollUsable(&r) {
+		// the files aren't registered automatically, so the thread can't take them
+		_ = teardown(&r)
+		r = ring{}
+		opts.SQPoll = false
+		err = setupOptions(uint32(sz), &r, opts)
+	}
+	if err != nil {
+		if !opts.SQPoll && !opts.IOPoll {
+			return err
+		}
+		// the kernel refuses the polling, the submissions are done by io_uring_enter and the completions are interrupt driven
+		if err := setup(uint32(sz), &r, 0); err != nil {
+			return err
+		}
 	}
 	c.r = &r
 	c.asyncMode = asyncIoUring
+	c.opcodes = probeOps(&r)
+	if r.flags&ioringSetupIoPoll != 0 {
+		// O_DIRECT requires the aligned buffers
+		c.iopoll = true
+		c.align = 512
+		c.alignedBuffers = make(map[unsafe.Pointer]slice)
+	}
 	return nil
 }
 
@@ -63,6 +165,71 @@ func (c *ctx) initAio(sz int) error {
 	return nil
 }
 
+func (c *ctx) close() error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return ErrCtxClosed
+	}
+	c.closed = true
+	files := make([]*File, 0, len(c.operationsFd))
+	for _, o := range c.operationsFd {
+		files = append(files, o.f)
+	}
+	c.Unlock()
+	// the held submissions fail and the barriers are completed
+	c.releaseFences()
+	// the stream is closed after the drain
+	defer c.closeDispatcher()
+
+	// the reaper must not take the completions the drain waits for
+	c.stopReaper()
+	offloaded := c.waitOffloaded()
+
+	var stuck []*Op
+	var err error
+	switch c.asyncMode {
+	case asyncIoUring:
+		stuck, err = c.closeIoUring()
+	case asyncAio:
+		stuck, err = c.closeAio()
+	default:
+		err = fmt.Errorf("unknown async mode '%v'", c.asyncMode)
+	}
+	if err != nil {
+		return err
+	}
+	for _, o := range offloaded {
+		files = append(files, o.f)
+	}
+	return pendingOpsError(files, append(stuck, offloaded...))
+}
+
+// failPending fails the operations still in flight with ErrCtxClosed,
+// the ones of the user are returned
+func (c *ctx) failPending() []*Op {
+	c.Lock()
+	ops := make([]*Op, 0, len(c.operationsFd))
+	var stuck []*Op
+	for k, o := range c.operationsFd {
+		delete(c.operationsFd, k)
+		o.err = ErrCtxClosed
+		ops = append(ops, o)
+		if !o.internal {
+			stuck = append(stuck, o)
+		}
+	}
+	c.currentCnt = 0
+	c.unfixLocked(ops)
+	c.Unlock()
+	// the kernel may still write to the buffers
+	abandon(ops)
+	if len(ops) > 0 {
+		c.completeOps(ops)
+	}
+	return stuck
+}
+
 func (c *ctx) allocBuf(sz int) []uint8 {
 	alloc := func(fullSz int) []uint8 {
 		var buf []uint8
@@ -76,7 +243,7 @@ func (c *ctx) allocBuf(sz int) []uint8 {
 		}
 		return buf
 	}
-	if c.asyncMode == asyncIoUring {
+	if c.asyncMode == asyncIoUring && !c.iopoll {
 		return alloc(sz)
 	}
 	buf := alloc(sz + c.align - 1)
@@ -96,6 +263,7 @@ func (c *ctx) allocBuf(sz int) []uint8 {
 }
 
 func (c *ctx) releaseBuf(b []uint8) {
+	c.unregisterBuf(b)
 	buf := b
 	if c.alignedBuffers != nil {
 		toRelease, ok := c.alignedBuffers[unsafe.Pointer(&b[0])]
@@ -116,6 +284,213 @@ func (c *ctx) releaseBuf(b []uint8) {
 	}
 }
 
+func (c *ctx) registerBufs(bufs [][]uint8) error {
+	if c.asyncMode != asyncIoUring {
+		return ErrNotSupported
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return ErrCtxClosed
+	}
+	cur := c.wantedBufs()
+	table := make([][]uint8, 0, len(cur)+len(bufs))
+	table = append(table, cur...)
+	for _, b := range bufs {
+		if len(b) > 0 {
+			table = append(table, b)
+		}
+	}
+	sort.Slice(table, func(i, j int) bool {
+		return uintptr(unsafe.Pointer(&table[i][0])) < uintptr(unsafe.Pointer(&table[j][0]))
+	})
+	return c.changeFixedBufs(table)
+}
+
+// unregisterBuf removes the buffers starting at b from the registered ones
+func (c *ctx) unregisterBuf(b []uint8) {
+	if c.asyncMode != asyncIoUring || len(b) == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	cur := c.wantedBufs()
+	table := make([][]uint8, 0, len(cur))
+	for _, fb := range cur {
+		if &fb[0] != &b[0] {
+			table = append(table, fb)
+		}
+	}
+	if len(table) != len(cur) {
+		_ = c.changeFixedBufs(table)
+	}
+}
+
+// wantedBufs returns the table the registered buffers are going to be, the lock must be held
+func (c *ctx) wantedBufs() [][]uint8 {
+	if c.bufsChanged {
+		return c.nextBufs
+	}
+	return c.fixedBufs
+}
+
+// changeFixedBufs replaces the registered buffers with the table, the lock must be held.
+// The registration reorders the indexes, so it is postponed while the sqes of the fixed operations may be in the ring:
+// they could be consumed by the kernel against the new table
+func (c *ctx) changeFixedBufs(table [][]uint8) error {
+	if c.fixedCnt > 0 {
+		c.nextBufs = table
+		c.bufsChanged = true
+		return nil
+	}
+	c.nextBufs = nil
+	c.bufsChanged = false
+	return c.setFixedBufs(table)
+}
+
+// unfixLocked uncounts the fixed operations the kernel is done with and replaces the registered buffers
+// if it has been postponed, the lock must be held
+func (c *ctx) unfixLocked(ops []*Op) {
+	for _, o := range ops {
+		if o.fixed {
+			o.fixed = false
+			c.fixedCnt--
+		}
+	}
+	if c.bufsChanged && c.fixedCnt == 0 {
+		_ = c.changeFixedBufs(c.nextBufs)
+	}
+}
+
+// setFixedBufs replaces the registered buffers with the table, the lock must be held.
+// The table can't be updated in place by the older kernels, so it is registered again
+func (c *ctx) setFixedBufs(table [][]uint8) error {
+	if len(c.fixedBufs) > 0 {
+		if err := unregisterBuffers(c.r); err != nil {
+			return err
+		}
+		c.fixedBufs = nil
+	}
+	if len(table) == 0 {
+		return nil
+	}
+	if err := registerBuffers(c.r, table); err != nil {
+		return err
+	}
+	c.fixedBufs = table
+	return nil
+}
+
+func (c *ctx) registerFiles(files []*File) error {
+	if c.asyncMode != asyncIoUring {
+		return ErrNotSupported
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return ErrCtxClosed
+	}
+	add := make([]*File, 0, len(files))
+	for _, f := range files {
+		if f.ctx != c {
+			return ErrForeignFile
+		}
+		if _, ok := c.fixedFiles[f]; ok || f.Mode() != ModeAsync {
+			continue
+		}
+		add = append(add, f)
+	}
+	if len(add) == 0 {
+		return nil
+	}
+
+	free := make([]int, 0, len(add))
+	for i, fd := range c.fileSlots {
+		if fd == -1 && len(free) < len(add) {
+			free = append(free, i)
+		}
+	}
+	if len(free) == len(add) {
+		for i, f := range add {
+			fd := int32(f.fd.Fd())
+			if err := updateFiles(c.r, free[i], fd); err != nil {
+				return err
+			}
+			c.fileSlots[free[i]] = fd
+			c.fixedFiles[f] = free[i]
+		}
+		return nil
+	}
+
+	// the table is full, it is registered again with the room for the next files
+	table := make([]int32, 2*(len(c.fileSlots)+len(add)))
+	copy(table, c.fileSlots)
+	for i := len(c.fileSlots); i < len(table); i++ {
+		table[i] = -1
+	}
+	slots := make(map[*File]int, len(c.fixedFiles)+len(add))
+	for f, slot := range c.fixedFiles {
+		slots[f] = slot
+	}
+	next := 0
+	for _, f := range add {
+		for table[next] != -1 {
+			next++
+		}
+		table[next] = int32(f.fd.Fd())
+		slots[f] = next
+	}
+	c.unregisterFilesLocked()
+	if err := registerFiles(c.r, table); err != nil {
+		return err
+	}
+	c.fileSlots = table
+	c.fixedFiles = slots
+	return nil
+}
+
+// unregisterFile releases the slot of the file, it is called before the file is closed
+func (c *ctx) unregisterFile(f *File) {
+	c.Lock()
+	defer c.Unlock()
+	slot, ok := c.fixedFiles[f]
+	if !ok || c.r == nil {
+		return
+	}
+	_ = updateFiles(c.r, slot, -1)
+	c.fileSlots[slot] = -1
+	delete(c.fixedFiles, f)
+}
+
+// unregisterFilesLocked releases the registered table, the lock must be held
+func (c *ctx) unregisterFilesLocked() {
+	if len(c.fileSlots) > 0 {
+		_ = unregisterFiles(c.r)
+	}
+	c.fileSlots = nil
+	c.fixedFiles = nil
+}
+
+// fixedBufIndex returns the index of the registered buffer containing b, the lock must be held
+func (c *ctx) fixedBufIndex(b []uint8) (int, bool) {
+	if len(c.fixedBufs) == 0 || c.bufsChanged {
+		// the table is going to be replaced
+		return 0, false
+	}
+	start := uintptr(unsafe.Pointer(&b[0]))
+	i := sort.Search(len(c.fixedBufs), func(i int) bool {
+		return uintptr(unsafe.Pointer(&c.fixedBufs[i][0])) > start
+	}) - 1
+	if i < 0 {
+		return 0, false
+	}
+	fb := c.fixedBufs[i]
+	if start+uintptr(len(b)) > uintptr(unsafe.Pointer(&fb[0]))+uintptr(len(fb)) {
+		return 0, false
+	}
+	return i, true
+}
+
 func (c *ctx) busy() bool {
 	if c.asyncMode == asyncIoUring {
 		c.Lock()
@@ -4,9 +4,11 @@ package asyncfs
 
 import (
 	"github.com/stretchr/testify/assert"
+	"os"
 	"runtime"
-	"sync"
+	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 )
 
@@ -17,6 +19,10 @@ func steps() []int {
 func prepare(t *testing.T, mode int) {
 	var sz int
 
+	if c != nil {
+		_ = c.close()
+	}
+
 	if mode == 0 { // windows/bsd
 		sz = 8
 		err := NewCtx(sz, sameThreadLim, nil, nil)
@@ -38,19 +44,15 @@ func prepare(t *testing.T, mode int) {
 		err := setup(uint32(sz), &r, 0)
 		assert.NoError(t, err)
 		c = new(ctx)
-		c.ioUringUserDataPool = sync.Pool{
-			New: func() interface{} {
-				return &cqUserData{}
-			},
-		}
 		c.r = &r
+		c.opcodes = probeOps(&r)
 	}
 
 	c.sz = sz
 	c.currentCnt = 0
 	c.align = 512
 	c.asyncMode = mode
-	c.operationsFd = make(map[unsafe.Pointer]*File, sz)
+	c.operationsFd = make(map[unsafe.Pointer]*Op, sz)
 	c.alignedBuffers = make(map[unsafe.Pointer]slice)
 	c.newThread = func(int) bool {
 		return false
@@ -81,3 +83,282 @@ func TestCtx_initAio(t *testing.T) {
 	assert.NotEqual(t, 0, c.aio)
 	assert.Equal(t, asyncAio, c.asyncMode)
 }
+
+func TestCtx_independent(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		t.Skip("skipping; linux-only test")
+	}
+	c1, err := New(8, sameThreadLim, nil, nil)
+	assert.NoError(t, err)
+	c2, err := New(16, 0, nil, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, c1.ctx, c2.ctx)
+	assert.Equal(t, 8, c1.ctx.sz)
+	assert.Equal(t, 16, c2.ctx.sz)
+	assert.False(t, c1.ctx.newThread(1024))
+	assert.True(t, c2.ctx.newThread(1024))
+
+	f1, err := c1.Open("/tmp/ctx_independent_1", syscall.O_RDWR|syscall.O_CREAT, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer os.Remove(f1.path)
+	f2, err := c2.Create("/tmp/ctx_independent_2", ModeAsync)
+	assert.NoError(t, err)
+	defer os.Remove(f2.path)
+	assert.Equal(t, c1.ctx, f1.ctx)
+	assert.Equal(t, c2.ctx, f2.ctx)
+
+	buf := c1.AllocBuf(4096)
+	_, err = f1.Write(buf)
+	assert.NoError(t, err)
+	_, err = f1.Wait(time.Second)
+	assert.NoError(t, err)
+	c1.ctx.Lock()
+	completed1 := c1.ctx.completedCnt
+	c1.ctx.Unlock()
+	c2.ctx.Lock()
+	completed2 := c2.ctx.completedCnt
+	pending2 := len(c2.ctx.operationsFd)
+	c2.ctx.Unlock()
+	assert.Equal(t, 0, pending2)
+	assert.Equal(t, uint64(0), completed2)
+	assert.Equal(t, uint64(1), completed1)
+	c1.ReleaseBuf(buf)
+}
+
+func TestCtx_Close(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./ctxClose"
+			f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			buf := AllocBuf(4096)
+			_, err = f.Write(buf)
+			assert.NoError(t, err)
+
+			err = c.close()
+			assert.Error(t, err)
+			pending, ok := err.(*PendingOpsError)
+			assert.True(t, ok)
+			if ok {
+				assert.Equal(t, []*File{f}, pending.Files)
+			}
+			assert.Equal(t, 0, len(c.operationsFd))
+			assert.True(t, f.lastAsyncOpState.complete)
+			assert.Equal(t, int64(4096), f.lastAsyncOpState.result)
+			assert.Nil(t, c.r)
+			assert.Equal(t, uint64(0), c.aio)
+
+			_, err = f.Write(buf)
+			assert.EqualError(t, err, ErrCtxClosed.Error())
+			assert.EqualError(t, c.close(), ErrCtxClosed.Error())
+			c = nil
+		}()
+	}
+}
+
+func TestCtx_Close_stuck(t *testing.T) {
+	grace := closeGrace
+	closeGrace = 100 * time.Millisecond
+	defer func() {
+		closeGrace = grace
+	}()
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./ctxCloseFifo"
+			assert.NoError(t, syscall.Mkfifo(path, 0644))
+			defer os.Remove(path)
+			// nobody writes to the fifo, so the read never completes by itself
+			f, err := Open(path, syscall.O_RDWR, 0644, ModeAsync)
+			if err != nil {
+				// O_DIRECT isn't supported by the fifo
+				c = nil
+				return
+			}
+			defer f.Close()
+
+			o, err := f.ReadAtAsync(make([]uint8, 4096), 0)
+			assert.NoError(t, err)
+			closed := make(chan error, 1)
+			go func() {
+				closed <- c.close()
+			}()
+			select {
+			case err = <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("close is blocked by the pending read")
+			}
+			pending, ok := err.(*PendingOpsError)
+			assert.True(t, ok)
+			if ok {
+				assert.Equal(t, []*File{f}, pending.Files)
+			}
+			assert.True(t, o.Done())
+			_, err = o.Result()
+			assert.Error(t, err)
+			c = nil
+		}()
+	}
+}
+
+func TestCtx_Close_idle(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		t.Skip("skipping; linux-only test")
+	}
+	fds := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		assert.NoError(t, err)
+		return len(entries)
+	}
+	before := fds()
+	for i := 0; i < 64; i++ {
+		x, err := New(8, sameThreadLim, nil, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, x.Close())
+	}
+	assert.Equal(t, before, fds())
+}
+
+func TestCtx_reaper(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		assert.NoError(t, c.initReaper())
+		func() {
+			path := "./ctxReaper"
+			f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			o, err := f.WriteAsync(AllocBuf(4096))
+			assert.NoError(t, err)
+			// nobody polls the kernel, the completion is delivered by the reaper
+			select {
+			case <-o.done:
+			case <-time.After(time.Second):
+				t.Fatal("too long")
+			}
+			n, err := o.Result()
+			assert.NoError(t, err)
+			assert.Equal(t, 4096, n)
+
+			assert.NoError(t, c.close())
+			select {
+			case <-c.reaperDone:
+			default:
+				t.Fatal("the reaper is still running")
+			}
+			assert.False(t, c.reaping)
+			c = nil
+		}()
+	}
+}
+
+func TestCtx_SQPoll(t *testing.T) {
+	if ioUringSetupSys <= 0 || ioUringEnterSys <= 0 {
+		t.Skip("io_uring doesn't supported")
+	}
+	x, err := NewWithOptions(8, sameThreadLim, nil, nil, RingOptions{
+		SQPoll:       true,
+		SQThreadIdle: time.Millisecond * 10,
+	})
+	assert.NoError(t, err)
+	defer x.Close()
+	if x.ctx.asyncMode != asyncIoUring {
+		t.Skip("io_uring doesn't supported")
+	}
+	if x.ctx.r.flags&ioringSetupSqPoll == 0 {
+		t.Skip("SQPOLL isn't permitted")
+	}
+
+	path := "./ctxSQPoll"
+	f, err := x.Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+	assert.NoError(t, err)
+	defer func() {
+		f.Close()
+		os.Remove(path)
+	}()
+
+	// the second write is submitted after the kernel thread has gone to sleep, so it has to be woken up
+	for i := 0; i < 2; i++ {
+		o, err := f.WriteAtAsync([]uint8{uint8(i)}, int64(i))
+		assert.NoError(t, err)
+		assert.NoError(t, o.Wait(time.Second))
+		n, err := o.Result()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		time.Sleep(time.Millisecond * 50)
+	}
+	buf := make([]uint8, 2)
+	n, err := f.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []uint8{0, 1}, buf)
+}
+
+func TestCtx_IOPoll(t *testing.T) {
+	if ioUringSetupSys <= 0 || ioUringEnterSys <= 0 {
+		t.Skip("io_uring doesn't supported")
+	}
+	x, err := NewWithOptions(8, sameThreadLim, nil, nil, RingOptions{IOPoll: true})
+	assert.NoError(t, err)
+	defer x.Close()
+	if x.ctx.asyncMode != asyncIoUring || !x.ctx.iopoll {
+		t.Skip("IOPOLL isn't supported")
+	}
+	assert.False(t, x.ctx.reaping)
+
+	// tmpfs doesn't support O_DIRECT, the disk may not support polling: the operations are offloaded then
+	for _, dir := range []string{".", "/dev/shm"} {
+		path := dir + "/ctxIOPoll"
+		f, err := x.Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+		if err != nil {
+			continue
+		}
+		func() {
+			defer func() {
+				f.Close()
+				os.Remove(path)
+			}()
+
+			_, err := f.WriteAtAsync(make([]uint8, 100), 0)
+			assert.Equal(t, ErrUnalignedData, err)
+
+			buf := x.AllocBuf(4096)
+			for i := range buf {
+				buf[i] = uint8(i)
+			}
+			o, err := f.WriteAtAsync(buf, 0)
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+			n, err := o.Result()
+			assert.NoError(t, err)
+			assert.Equal(t, 4096, n)
+
+			o, err = f.SyncAsync()
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+			_, err = o.Result()
+			assert.NoError(t, err)
+
+			out := x.AllocBuf(4096)
+			o, err = f.ReadAtAsync(out, 0)
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+			n, err = o.Result()
+			assert.NoError(t, err)
+			assert.Equal(t, 4096, n)
+			assert.Equal(t, buf, out)
+			x.ReleaseBuf(buf)
+			x.ReleaseBuf(out)
+		}()
+	}
+}
@@ -5,6 +5,7 @@ package asyncfs
 import (
 	"fmt"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -15,10 +16,18 @@ type (
 		nWriteFile           uint64
 		nReadFile            uint64
 		nGetOverlappedResult uint64
-		operationsFd         map[unsafe.Pointer]*File
+		nCancelIoEx          uint64
+		nWaitForMultiple     uint64
+		operationsFd         map[unsafe.Pointer]*Op
+		// events are the free events of the overlapped operations, the wait blocks on the events of the pending ones.
+		// They are reused instead of closed, so an event isn't closed under a waiter
+		events []syscall.Handle
 	}
 )
 
+// maximumWaitObjects is MAXIMUM_WAIT_OBJECTS, the most handles WaitForMultipleObjects takes
+const maximumWaitObjects = 64
+
 func (c *ctx) initCtx(sz int) error {
 	k32, err := syscall.LoadLibrary("kernel32.dll")
 	if err != nil {
@@ -49,15 +58,200 @@ func (c *ctx) initCtx(sz int) error {
 	}
 	c.nGetOverlappedResult = gor
 
-	c.operationsFd = make(map[unsafe.Pointer]*File, sz)
+	cio, err := getProcAddr(k32, "CancelIoEx")
+	if err != nil {
+		return fmt.Errorf("CancelIoEx: '%s'", err)
+	}
+	c.nCancelIoEx = cio
+
+	wfm, err := getProcAddr(k32, "WaitForMultipleObjects")
+	if err != nil {
+		return fmt.Errorf("WaitForMultipleObjects: '%s'", err)
+	}
+	c.nWaitForMultiple = wfm
+
+	c.operationsFd = make(map[unsafe.Pointer]*Op, sz)
 
 	return nil
 }
 
+func (c *ctx) close() error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return ErrCtxClosed
+	}
+	c.closed = true
+	ops := make([]*Op, 0, len(c.operationsFd))
+	files := make([]*File, 0, len(c.operationsFd))
+	for _, o := range c.operationsFd {
+		ops = append(ops, o)
+		files = append(files, o.f)
+	}
+	c.Unlock()
+	// the held submissions fail and the barriers are completed
+	c.releaseFences()
+	// the stream is closed after the drain
+	defer c.closeDispatcher()
+	offloaded := c.waitOffloaded()
+
+	// the operations still in flight after closeGrace are cancelled by CancelIoEx,
+	// the ones which are neither completed nor cancelled after closeGrace more are failed with ErrCtxClosed
+	var stuck []*Op
+	if !pollOps(ops, closeGrace) {
+		for _, o := range ops {
+			if !o.Done() {
+				_ = c.cancel(o)
+			}
+		}
+		if !pollOps(ops, closeGrace) {
+			stuck = c.failPending()
+		}
+	}
+	c.Lock()
+	for _, h := range c.events {
+		_ = syscall.CloseHandle(h)
+	}
+	c.events = nil
+	c.Unlock()
+	for _, o := range offloaded {
+		files = append(files, o.f)
+	}
+	return pendingOpsError(files, append(stuck, offloaded...))
+}
+
+// pollOps polls the operations until they are completed, false is returned if the timeout expires first
+func pollOps(ops []*Op, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for _, o := range ops {
+		for !o.Done() {
+			if !time.Now().Before(deadline) {
+				return false
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return true
+}
+
+// failPending fails the operations still in flight with ErrCtxClosed,
+// the ones of the user are returned
+func (c *ctx) failPending() []*Op {
+	c.Lock()
+	ops := make([]*Op, 0, len(c.operationsFd))
+	var stuck []*Op
+	for k, o := range c.operationsFd {
+		delete(c.operationsFd, k)
+		c.releaseEvent(o)
+		o.err = ErrCtxClosed
+		ops = append(ops, o)
+		if !o.internal {
+			stuck = append(stuck, o)
+		}
+	}
+	c.Unlock()
+	// the kernel may still write to the buffers
+	abandon(ops)
+	if len(ops) > 0 {
+		c.completeOps(ops)
+	}
+	return stuck
+}
+
+// wait blocks on the events of the pending operations until something is completed or the timeout expires
+func (c *ctx) wait(min int, timeout time.Duration) error {
+	c.Lock()
+	ops := make([]*Op, 0, len(c.operationsFd))
+	events := make([]syscall.Handle, 0, maximumWaitObjects)
+	for _, o := range c.operationsFd {
+		ops = append(ops, o)
+		if o.ov.HEvent != 0 && len(events) < maximumWaitObjects {
+			events = append(events, o.ov.HEvent)
+		}
+	}
+	c.Unlock()
+	if err := pollAll(ops); err != nil {
+		return err
+	}
+	c.Lock()
+	reaped := c.reaped
+	c.Unlock()
+	if reaped == nil || timeout == 0 {
+		return nil
+	}
+
+	if len(events) == 0 {
+		// nothing is in the kernel, the operations done by the goroutines close reaped
+		var expired <-chan time.Time
+		if timeout > 0 {
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			expired = t.C
+		}
+		select {
+		case <-reaped:
+		case <-expired:
+		}
+		return nil
+	}
+	if len(events) < len(ops) && (timeout < 0 || timeout > waitSlice) {
+		// the operations without the watched events are polled after the slice
+		timeout = waitSlice
+	}
+	ms := uint32(syscall.INFINITE)
+	if timeout >= 0 {
+		ms = uint32((timeout + time.Millisecond - 1) / time.Millisecond)
+	}
+	r1, _, e := syscall.Syscall6(uintptr(c.nWaitForMultiple), 4, uintptr(len(events)), uintptr(unsafe.Pointer(&events[0])), 0, uintptr(ms), 0, 0)
+	if uint32(r1) == syscall.WAIT_FAILED {
+		return e
+	}
+	return pollAll(ops)
+}
+
+// pollAll takes the results of the completed operations
+func pollAll(ops []*Op) error {
+	for _, o := range ops {
+		if err := o.poll(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeEvent returns a free event for the overlapped operation, 0 is returned if it can't be created
+// and the operation is polled then. The lock must be held
+func (c *ctx) takeEvent() syscall.Handle {
+	if n := len(c.events); n > 0 {
+		h := c.events[n-1]
+		c.events = c.events[:n-1]
+		return h
+	}
+	// the manual-reset event is reset by ReadFile and WriteFile at the start
+	r1, _, _ := syscall.Syscall6(uintptr(c.nCreateEvent), 4, 0, 1, 0, 0, 0, 0)
+	return syscall.Handle(r1)
+}
+
+// releaseEvent returns the event of the reaped operation to the free ones, the lock must be held
+func (c *ctx) releaseEvent(o *Op) {
+	if o.ov.HEvent != 0 {
+		c.events = append(c.events, o.ov.HEvent)
+		o.ov.HEvent = 0
+	}
+}
+
 func (c *ctx) haveToAlign() bool {
 	return false
 }
 
+func (c *ctx) registerBufs(bufs [][]uint8) error {
+	return ErrNotSupported
+}
+
+func (c *ctx) registerFiles(files []*File) error {
+	return ErrNotSupported
+}
+
 func (c *ctx) busy() bool {
 	return false
 }
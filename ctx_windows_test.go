@@ -14,6 +14,10 @@ func steps() []int {
 func prepare(t *testing.T, mode int) {
 	var sz int
 
+	if c != nil {
+		_ = c.close()
+	}
+
 	if mode == 0 { // windows/bsd
 		sz = 8
 		err := NewCtx(sz, sameThreadLim, nil, nil)
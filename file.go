@@ -1,12 +1,15 @@
 package asyncfs
 
 import (
+	"context"
 	"errors"
 	"io"
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 const (
@@ -17,6 +20,7 @@ const (
 type (
 	File struct {
 		fileCtx
+		ctx              *ctx
 		fd               *os.File
 		mtx              sync.Mutex
 		lastSyncSeek     bool
@@ -24,11 +28,14 @@ type (
 		pos              int64
 		path             string
 		lastAsyncOpState asyncOpState
+		// timeout of the submitted operations in nanoseconds, it is accessed atomically
+		timeout int64
 	}
 )
 
 var ErrNotCompleted = errors.New("operation isn't completed")
 var ErrCtxBusy = errors.New("ctx is busy")
+var ErrCtxClosed = errors.New("ctx is closed")
 var ErrUnknownOperation = errors.New("unknown operation")
 var ErrNotSubmittedAio = errors.New("failed aio submit")
 var ErrAioError = errors.New("aio error")
@@ -36,9 +43,12 @@ var ErrNotSubmittedIoUring = errors.New("failed io_uring submit")
 var ErrNotSupported = errors.New("not supported")
 var ErrNotImplemented = errors.New("not implemented")
 var ErrEOF = io.EOF
+var ErrForeignFile = errors.New("file belongs to another ctx")
+var ErrNotCancelled = errors.New("operation can't be cancelled")
+var ErrTimeout = errors.New("operation timed out")
 
 func Open(path string, mode int, perm os.FileMode, openMode uint8) (*File, error) {
-	return open(path, mode, perm, openMode)
+	return c.open(path, mode, perm, openMode)
 }
 
 func Create(path string, fsMode uint8) (*File, error) {
@@ -93,6 +103,40 @@ func (f *File) ReadSync(data []uint8) (int, error) {
 	return f.readSync(data)
 }
 
+// ReadAt reads len(data) bytes at the offset with pread, the position of the file isn't changed.
+// As io.ReaderAt, ErrEOF is returned if less than len(data) bytes have been read.
+func (f *File) ReadAt(data []uint8, off int64) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	n, err := f.readAtSync(data, off)
+	runtime.KeepAlive(f)
+	return n, err
+}
+
+// WriteAt writes data at the offset with pwrite, the position of the file isn't changed
+func (f *File) WriteAt(data []uint8, off int64) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	n, err := f.writeAtSync(data, off)
+	runtime.KeepAlive(f)
+	return n, err
+}
+
+// Sync flushes the file to the storage, the goroutine is parked until it is done
+func (f *File) Sync() error {
+	o, err := f.SyncAsync()
+	if err != nil {
+		return err
+	}
+	if err := o.Wait(-1); err != nil {
+		return err
+	}
+	_, err = o.Result()
+	return err
+}
+
 func (f *File) LastOp() (int, bool, error) {
 	if f.Mode() == ModeSync {
 		return 0, true, nil
@@ -118,6 +162,134 @@ func (f *File) LastOp() (int, bool, error) {
 	return int(res), complete, nil
 }
 
+// Wait blocks until the last asynchronous operation is completed or the timeout expires.
+// A negative timeout waits forever. ErrNotCompleted is returned on the timeout
+// and if a newer operation has been submitted while waiting.
+func (f *File) Wait(timeout time.Duration) (int, error) {
+	f.mtx.Lock()
+	o := f.lastAsyncOpState.op
+	f.mtx.Unlock()
+	if o != nil {
+		if err := o.Wait(timeout); err != nil {
+			return 0, err
+		}
+		return f.lastOpOnce()
+	}
+
+	// the cursor operations of windows have no Op, so their state is polled
+	deadline := time.Now().Add(timeout)
+	for {
+		n, ok, err := f.LastOp()
+		if ok || err != nil {
+			return n, err
+		}
+		if timeout >= 0 && !time.Now().Before(deadline) {
+			return 0, ErrNotCompleted
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// lastOpOnce returns the state published by the completed operation,
+// ErrNotCompleted is returned if a newer operation has been submitted meanwhile
+func (f *File) lastOpOnce() (int, error) {
+	n, ok, err := f.LastOp()
+	if !ok && err == nil {
+		return 0, ErrNotCompleted
+	}
+	return n, err
+}
+
+// WaitContext blocks until the last asynchronous operation is completed or cx is done.
+// If cx is done first, the operation is cancelled like Op.WaitContext does.
+// ErrNotCompleted is returned if a newer operation has been submitted while waiting.
+func (f *File) WaitContext(cx context.Context) (int, error) {
+	f.mtx.Lock()
+	o := f.lastAsyncOpState.op
+	f.mtx.Unlock()
+	if o != nil {
+		if err := o.WaitContext(cx); err != nil {
+			return 0, err
+		}
+		return f.lastOpOnce()
+	}
+
+	// the cursor operations of windows have no Op, so their state is polled
+	for {
+		n, ok, err := f.LastOp()
+		if ok || err != nil {
+			return n, err
+		}
+		select {
+		case <-cx.Done():
+			return 0, cx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// ReadContext reads from the current position and blocks until the read is completed or cx is done.
+// The position is advanced at the submission like ReadAsync does. If cx is done first, the read is cancelled,
+// the buffer isn't touched by the kernel after the return and the error of cx is returned. The position is moved back
+// past the bytes read before the cancellation then, unless another operation has been submitted at the position meanwhile.
+func (f *File) ReadContext(cx context.Context, data []uint8) (int, error) {
+	if err := cx.Err(); err != nil {
+		return 0, err
+	}
+	o, err := f.ReadAsync(data)
+	if err != nil {
+		return 0, err
+	}
+	if err := o.WaitContext(cx); err != nil {
+		f.rewind(o)
+		return 0, err
+	}
+	return o.Result()
+}
+
+// WriteContext writes at the current position and blocks until the write is completed or cx is done, see ReadContext
+func (f *File) WriteContext(cx context.Context, data []uint8) (int, error) {
+	if err := cx.Err(); err != nil {
+		return 0, err
+	}
+	o, err := f.WriteAsync(data)
+	if err != nil {
+		return 0, err
+	}
+	if err := o.WaitContext(cx); err != nil {
+		f.rewind(o)
+		return 0, err
+	}
+	return o.Result()
+}
+
+// rewind moves the position back to the end of what the cancelled operation has transferred,
+// the position is left alone if a later operation has moved it
+func (f *File) rewind(o *Op) {
+	if !o.isDone() {
+		return
+	}
+	end := o.off
+	if o.result > 0 {
+		end += o.result
+	}
+	f.mtx.Lock()
+	if f.pos == o.off+int64(o.size()) {
+		f.pos = end
+	}
+	f.mtx.Unlock()
+}
+
+// SetTimeout sets the timeout of the operations submitted after the call.
+// An operation which isn't completed in time is cancelled and completed with ErrTimeout.
+// The operations already running in the device may be impossible to cancel, they are completed as usual then.
+// The linux aio backend can't cancel the reads and writes of the regular files at all (io_cancel fails with EINVAL),
+// so ErrTimeout isn't reported there and the operations are completed once the device finishes them.
+// Zero disables the timeouts.
+func (f *File) SetTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&f.timeout, int64(timeout))
+}
+
 func (f *File) Pos() int64 {
 	if f.Mode() == ModeSync {
 		return f.pos
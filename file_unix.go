@@ -16,39 +16,48 @@ const (
 )
 
 type (
-	fileCtx struct{}
+	fileCtx struct {
+		// unpolled is set atomically once the device rejects the polled I/O, the operations are offloaded then
+		unpolled int32
+	}
 )
 
-func open(path string, flag int, perm os.FileMode, fType uint8) (*File, error) {
-	var resFile File
-	var fd *os.File
-	var mode uint8
+func (c *ctx) open(path string, flag int, perm os.FileMode, fType uint8) (*File, error) {
+	f, err := c.newFile(path, fType)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.openFd(flag, perm); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
 
+// newFile makes the file of the context, its descriptor is opened by openFd
+func (c *ctx) newFile(path string, fType uint8) (*File, error) {
+	f := &File{
+		ctx:  c,
+		path: path,
+		mode: fType,
+	}
 	switch fType {
 	case ModeAsync:
-		f, err := openAsync(path, flag, perm)
-		if err != nil {
-			return nil, err
-		}
-		fd = f
-		mode = ModeAsync
-		resFile.lastAsyncOpState.complete = true
+		f.lastAsyncOpState.complete = true
 	case ModeSync:
-		f, err := os.OpenFile(path, flag, perm)
-		if err != nil {
-			return nil, err
-		}
-		fd = f
-		mode = ModeSync
 	default:
 		return nil, fmt.Errorf("unknown type '%v'", fType)
 	}
+	return f, nil
+}
 
-	resFile.path = path
-	resFile.fd = fd
-	resFile.mode = mode
-
-	return &resFile, nil
+func (f *File) openFd(flag int, perm os.FileMode) error {
+	var err error
+	if f.mode == ModeAsync {
+		f.fd, err = f.ctx.openAsync(f.path, flag, perm)
+	} else {
+		f.fd, err = os.OpenFile(f.path, flag, perm)
+	}
+	return err
 }
 
 func (f *File) writeSync(data []uint8) (int, error) {
@@ -58,7 +67,7 @@ func (f *File) writeSync(data []uint8) (int, error) {
 		}
 	}
 
-	if !c.newThread(len(data)) {
+	if !f.ctx.newThread(len(data)) {
 		nn, _, e := syscall.RawSyscall(syscall.SYS_WRITE, f.fd.Fd(), uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)))
 		if e != 0 {
 			return int(nn), e
@@ -90,7 +99,7 @@ func (f *File) readSync(data []uint8) (int, error) {
 		}
 	}
 
-	if !c.newThread(len(data)) {
+	if !f.ctx.newThread(len(data)) {
 		nn, _, e := syscall.RawSyscall(syscall.SYS_READ, f.fd.Fd(), uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)))
 		if e != 0 {
 			return int(nn), e
@@ -115,6 +124,39 @@ func (f *File) readSync(data []uint8) (int, error) {
 	return n, nil
 }
 
+func (f *File) writeAtSync(data []uint8, off int64) (int, error) {
+	if len(data) > 0 && !f.ctx.newThread(len(data)) {
+		nn, err := rawPwrite(int(f.fd.Fd()), data, off)
+		if err != nil {
+			return 0, err
+		}
+		if nn != len(data) {
+			return nn, io.ErrShortWrite
+		}
+		return nn, nil
+	}
+	return f.fd.WriteAt(data, off)
+}
+
+func (f *File) readAtSync(data []uint8, off int64) (int, error) {
+	if len(data) > 0 && !f.ctx.newThread(len(data)) {
+		// a short read isn't the end of the file, only the empty one is
+		var done int
+		for done < len(data) {
+			nn, err := rawPread(int(f.fd.Fd()), data[done:], off+int64(done))
+			if err != nil {
+				return done, err
+			}
+			if nn == 0 {
+				return done, ErrEOF
+			}
+			done += nn
+		}
+		return done, nil
+	}
+	return f.fd.ReadAt(data, off)
+}
+
 func (f *File) checkAsyncResult() error {
 	if f.Mode() == ModeSync {
 		return nil
@@ -20,37 +20,43 @@ type (
 	}
 )
 
-func open(path string, flag int, perm os.FileMode, fType uint8) (*File, error) {
-	var resFile File
-	var fd *os.File
-	var mode uint8
+func (c *ctx) open(path string, flag int, perm os.FileMode, fType uint8) (*File, error) {
+	f, err := c.newFile(path, fType)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.openFd(flag, perm); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
 
+// newFile makes the file of the context, its descriptor is opened by openFd
+func (c *ctx) newFile(path string, fType uint8) (*File, error) {
+	f := &File{
+		ctx:  c,
+		path: path,
+		mode: fType,
+	}
 	switch fType {
 	case ModeAsync:
-		f, err := openAsync(path, flag, perm)
-		if err != nil {
-			return nil, err
-		}
-		fd = f
-		mode = ModeAsync
-		resFile.setOverlapped(true, true)
-		resFile.lastAsyncOpState.complete = true
+		f.setOverlapped(true, true)
+		f.lastAsyncOpState.complete = true
 	case ModeSync:
-		f, err := os.OpenFile(path, flag, perm)
-		if err != nil {
-			return nil, err
-		}
-		fd = f
-		mode = ModeSync
 	default:
 		return nil, fmt.Errorf("unknown type '%v'", fType)
 	}
+	return f, nil
+}
 
-	resFile.path = path
-	resFile.fd = fd
-	resFile.mode = mode
-
-	return &resFile, nil
+func (f *File) openFd(flag int, perm os.FileMode) error {
+	var err error
+	if f.mode == ModeAsync {
+		f.fd, err = f.ctx.openAsync(f.path, flag, perm)
+	} else {
+		f.fd, err = os.OpenFile(f.path, flag, perm)
+	}
+	return err
 }
 
 func (f *File) writeSync(data []uint8) (int, error) {
@@ -58,7 +64,7 @@ func (f *File) writeSync(data []uint8) (int, error) {
 		if n, err := f.checkAsyncSeek(); err != nil {
 			return n, err
 		}
-		return f.rwSync(c.nWriteFile, data)
+		return f.rwSync(f.ctx.nWriteFile, data)
 	}
 	n, err := f.fd.Write(data)
 	if err != nil {
@@ -76,7 +82,7 @@ func (f *File) readSync(data []uint8) (int, error) {
 		if n, err := f.checkAsyncSeek(); err != nil {
 			return n, err
 		}
-		return f.rwSync(c.nReadFile, data)
+		return f.rwSync(f.ctx.nReadFile, data)
 	}
 	n, err := f.fd.Read(data)
 	if err != nil {
@@ -117,6 +123,36 @@ func (f *File) rwSync(nOp uint64, data []uint8) (int, error) {
 	return int(f.processedBytes), nil
 }
 
+func (f *File) writeAtSync(data []uint8, off int64) (int, error) {
+	if f.mode == ModeAsync {
+		// the handle is overlapped, so the positional I/O goes through an operation
+		return f.waitAt(OpWrite, data, off)
+	}
+	return f.fd.WriteAt(data, off)
+}
+
+func (f *File) readAtSync(data []uint8, off int64) (int, error) {
+	if f.mode == ModeAsync {
+		n, err := f.waitAt(OpRead, data, off)
+		if err == nil && n < len(data) {
+			return n, ErrEOF
+		}
+		return n, err
+	}
+	return f.fd.ReadAt(data, off)
+}
+
+func (f *File) waitAt(kind int, data []uint8, off int64) (int, error) {
+	o, err := f.submitAt(newOp(f, kind, data, off))
+	if err != nil {
+		return 0, err
+	}
+	if err := o.Wait(-1); err != nil {
+		return 0, err
+	}
+	return o.Result()
+}
+
 func (f *File) checkAsyncResult() error {
 	if f.Mode() == ModeSync {
 		return nil
@@ -147,7 +183,7 @@ func (f *File) checkAsyncResult() error {
 		wait = 1
 	}
 
-	r1, _, e := syscall.Syscall6(uintptr(c.nGetOverlappedResult), 4, f.fd.Fd(), uintptr(unsafe.Pointer(ov)), uintptr(unsafe.Pointer(&n)), uintptr(wait), 0, 0)
+	r1, _, e := syscall.Syscall6(uintptr(f.ctx.nGetOverlappedResult), 4, f.fd.Fd(), uintptr(unsafe.Pointer(ov)), uintptr(unsafe.Pointer(&n)), uintptr(wait), 0, 0)
 	f.processedBytes += n
 	if r1 == 0 {
 		if e == syscall.ERROR_IO_PENDING || e == 996 { // WSA_IO_INCOMPLETE(996)
@@ -0,0 +1,168 @@
+package asyncfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// OpenAsync submits the open of the file. File of the operation is bound to the context
+// and can be used once the operation is completed successfully
+func (c *Ctx) OpenAsync(path string, flag int, perm os.FileMode, openMode uint8) (*Op, error) {
+	return c.ctx.openAsyncOp(path, flag, perm, openMode)
+}
+
+// OpenAsync submits the open of the file to the default context
+func OpenAsync(path string, flag int, perm os.FileMode, openMode uint8) (*Op, error) {
+	return c.openAsyncOp(path, flag, perm, openMode)
+}
+
+// StatPathAsync submits stat of the path, the symlinks are followed
+func (c *Ctx) StatPathAsync(path string) (*Op, error) {
+	return c.ctx.statPathAsync(path)
+}
+
+// StatPathAsync submits stat of the path to the default context
+func StatPathAsync(path string) (*Op, error) {
+	return c.statPathAsync(path)
+}
+
+// RenameAsync submits the rename of oldpath to newpath, newpath is replaced if it exists
+func (c *Ctx) RenameAsync(oldpath, newpath string) (*Op, error) {
+	return c.ctx.submitPathOp(newPathOp(c.ctx, OpRename, oldpath, newpath))
+}
+
+// RenameAsync submits the rename to the default context
+func RenameAsync(oldpath, newpath string) (*Op, error) {
+	return c.submitPathOp(newPathOp(c, OpRename, oldpath, newpath))
+}
+
+// UnlinkAsync submits the removal of the file, the directories aren't removed
+func (c *Ctx) UnlinkAsync(path string) (*Op, error) {
+	return c.ctx.submitPathOp(newPathOp(c.ctx, OpUnlink, path, ""))
+}
+
+// UnlinkAsync submits the removal of the file to the default context
+func UnlinkAsync(path string) (*Op, error) {
+	return c.submitPathOp(newPathOp(c, OpUnlink, path, ""))
+}
+
+// MkdirAsync submits the creation of the directory
+func (c *Ctx) MkdirAsync(path string, perm os.FileMode) (*Op, error) {
+	return c.ctx.mkdirAsync(path, perm)
+}
+
+// MkdirAsync submits the creation of the directory to the default context
+func MkdirAsync(path string, perm os.FileMode) (*Op, error) {
+	return c.mkdirAsync(path, perm)
+}
+
+// LinkAsync submits the creation of newname as a hard link to oldname
+func (c *Ctx) LinkAsync(oldname, newname string) (*Op, error) {
+	return c.ctx.submitPathOp(newPathOp(c.ctx, OpLink, oldname, newname))
+}
+
+// LinkAsync submits the creation of the hard link to the default context
+func LinkAsync(oldname, newname string) (*Op, error) {
+	return c.submitPathOp(newPathOp(c, OpLink, oldname, newname))
+}
+
+// SymlinkAsync submits the creation of newname as a symbolic link to oldname
+func (c *Ctx) SymlinkAsync(oldname, newname string) (*Op, error) {
+	return c.ctx.submitPathOp(newPathOp(c.ctx, OpSymlink, oldname, newname))
+}
+
+// SymlinkAsync submits the creation of the symbolic link to the default context
+func SymlinkAsync(oldname, newname string) (*Op, error) {
+	return c.submitPathOp(newPathOp(c, OpSymlink, oldname, newname))
+}
+
+// CloseAsync submits the close of the file, the file can't be used after the submission
+func (f *File) CloseAsync() (*Op, error) {
+	return f.submitAt(newOp(f, OpClose, nil, 0))
+}
+
+// StatAsync submits stat of the file
+func (f *File) StatAsync() (*Op, error) {
+	return f.submitAt(newOp(f, OpStat, nil, 0))
+}
+
+// Stat returns the result of StatAsync or StatPathAsync
+func (o *Op) Stat() (os.FileInfo, error) {
+	if !o.Done() {
+		return nil, ErrNotCompleted
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+	return o.info, nil
+}
+
+func (c *ctx) openAsyncOp(path string, flag int, perm os.FileMode, openMode uint8) (*Op, error) {
+	f, err := c.newFile(path, openMode)
+	if err != nil {
+		return nil, err
+	}
+	o := newOp(f, OpOpen, nil, 0)
+	o.path = path
+	o.flag = flag
+	o.mode = uint32(perm)
+	return f.submitAt(o)
+}
+
+func (c *ctx) statPathAsync(path string) (*Op, error) {
+	return c.submitPathOp(newPathOp(c, OpStat, path, ""))
+}
+
+func (c *ctx) mkdirAsync(path string, perm os.FileMode) (*Op, error) {
+	o := newPathOp(c, OpMkdir, path, "")
+	o.mode = uint32(perm)
+	return c.submitPathOp(o)
+}
+
+// newPathOp makes the operation on the paths
+func newPathOp(c *ctx, kind int, path, path2 string) *Op {
+	o := newCtxOp(c, kind)
+	o.path = path
+	o.path2 = path2
+	return o
+}
+
+// submitPathOp submits the operation which isn't bound to a file
+func (c *ctx) submitPathOp(o *Op) (*Op, error) {
+	start := func() {
+		if err := c.submitPath(o); err != nil {
+			o.err = err
+			c.completeOps([]*Op{o})
+		}
+	}
+	if c.gate([]*Op{o}, start) {
+		return o, nil
+	}
+	if err := c.submitPath(o); err != nil {
+		c.ungate([]*Op{o})
+		return nil, err
+	}
+	return o, nil
+}
+
+// doPath does the operation on the path with the synchronous calls
+func (o *Op) doPath() (int64, error) {
+	switch o.kind {
+	case OpStat:
+		st, err := os.Stat(o.path)
+		o.info = st
+		return 0, err
+	case OpRename:
+		return 0, os.Rename(o.path, o.path2)
+	case OpUnlink:
+		return 0, syscall.Unlink(o.path)
+	case OpMkdir:
+		return 0, os.Mkdir(o.path, os.FileMode(o.mode))
+	case OpLink:
+		return 0, os.Link(o.path, o.path2)
+	case OpSymlink:
+		return 0, os.Symlink(o.path, o.path2)
+	default:
+		return 0, ErrUnknownOperation
+	}
+}
@@ -0,0 +1,142 @@
+package asyncfs
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpenAsync(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./open_async"
+			defer os.Remove(path)
+
+			o, err := OpenAsync(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+			_, err = o.Result()
+			assert.NoError(t, err)
+			f := o.File()
+			assert.Equal(t, path, f.Path())
+
+			buf := AllocBuf(4096)
+			o, err = f.WriteAtAsync(buf, 0)
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+
+			o, err = f.StatAsync()
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+			st, err := o.Stat()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(buf)), st.Size())
+			assert.Equal(t, "open_async", st.Name())
+			assert.True(t, st.Mode().IsRegular())
+
+			o, err = StatPathAsync(path)
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+			st, err = o.Stat()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(buf)), st.Size())
+			assert.Nil(t, o.File())
+
+			o, err = f.CloseAsync()
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+			_, err = o.Result()
+			assert.NoError(t, err)
+
+			o, err = StatPathAsync("./not_exists")
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+			_, err = o.Stat()
+			assert.True(t, errors.Is(err, os.ErrNotExist))
+
+			o, err = OpenAsync("./not_exists", syscall.O_RDONLY, 0, ModeAsync)
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+			_, err = o.Result()
+			assert.True(t, errors.Is(err, os.ErrNotExist))
+		}()
+	}
+}
+
+func TestPathOps(t *testing.T) {
+	wait := func(o *Op, err error) error {
+		assert.NoError(t, err)
+		assert.NoError(t, o.Wait(time.Second))
+		_, err = o.Result()
+		return err
+	}
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			dir := "./path_ops"
+			defer os.RemoveAll(dir)
+
+			assert.NoError(t, wait(MkdirAsync(dir, 0755)))
+			assert.True(t, errors.Is(wait(MkdirAsync(dir, 0755)), os.ErrExist))
+			assert.NoError(t, os.WriteFile(dir+"/a", []uint8("data"), 0644))
+
+			assert.NoError(t, wait(RenameAsync(dir+"/a", dir+"/b")))
+			assert.NoError(t, wait(LinkAsync(dir+"/b", dir+"/c")))
+			assert.NoError(t, wait(SymlinkAsync("b", dir+"/d")))
+			for _, name := range []string{"b", "c", "d"} {
+				o, err := StatPathAsync(dir + "/" + name)
+				assert.NoError(t, err)
+				assert.NoError(t, o.Wait(time.Second))
+				st, err := o.Stat()
+				assert.NoError(t, err)
+				assert.Equal(t, int64(4), st.Size())
+			}
+			_, err := os.Stat(dir + "/a")
+			assert.True(t, os.IsNotExist(err))
+
+			for _, name := range []string{"b", "c", "d"} {
+				assert.NoError(t, wait(UnlinkAsync(dir+"/"+name)))
+			}
+			entries, err := os.ReadDir(dir)
+			assert.NoError(t, err)
+			assert.Empty(t, entries)
+			// the directories aren't unlinked
+			assert.Error(t, wait(UnlinkAsync(dir)))
+		}()
+	}
+}
+
+func TestPathOps_Cancel(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			dir := "./path_cancel"
+			defer os.RemoveAll(dir)
+			assert.NoError(t, os.Mkdir(dir, 0755))
+			assert.NoError(t, os.WriteFile(dir+"/a", nil, 0644))
+
+			ops := make([]*Op, 0, 4)
+			for _, fn := range []func() (*Op, error){
+				func() (*Op, error) { return RenameAsync(dir+"/a", dir+"/b") },
+				func() (*Op, error) { return StatPathAsync(dir) },
+				func() (*Op, error) { return MkdirAsync(dir+"/c", 0755) },
+				func() (*Op, error) { return SymlinkAsync("b", dir+"/d") },
+			} {
+				o, err := fn()
+				assert.NoError(t, err)
+				ops = append(ops, o)
+				// the operation is either cancelled or already being done
+				if err := o.Cancel(); err != nil {
+					assert.Equal(t, ErrNotCancelled, err)
+				}
+			}
+			for _, o := range ops {
+				assert.NoError(t, o.Wait(time.Second))
+			}
+		}()
+	}
+}
@@ -0,0 +1,510 @@
+package asyncfs
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type (
+	// Op is a handle of an asynchronous operation.
+	// Many operations can be in flight for one file, each of them is completed independently.
+	Op struct {
+		opCtx
+		c      *ctx
+		f      *File
+		kind   int
+		buf    []uint8
+		off    int64
+		result int64
+		err    error
+		cursor bool
+		done   chan struct{}
+		// bufs are the buffers of a vectored operation, buf is nil or their gathered copy then
+		bufs [][]uint8
+		// length and mode are the arguments of the operations without a buffer
+		length int64
+		mode   uint32
+		// path, path2 and flag are the arguments of the operations on the paths, info is the result of stat
+		path  string
+		path2 string
+		flag  int
+		info  os.FileInfo
+		// internal operations are submitted by the package itself, they aren't counted and dispatched
+		internal bool
+		// timeout is taken from the file at the creation, timer cancels the operation if the kernel can't do it.
+		// timer is guarded by the ctx lock
+		timeout time.Duration
+		timer   *time.Timer
+		// cancelled is set atomically by Cancel, so ECANCELED isn't reported as ErrTimeout
+		cancelled int32
+		// abort interrupts the offloaded operation if it can be stopped, it is guarded by the ctx lock
+		abort func()
+		// next is started when the operation is completed if the chain is emulated in userspace
+		next     *Op
+		hardlink bool
+		// inflight is set while the operation is counted by the ctx, it is guarded by the ctx lock
+		inflight bool
+		// drain is set while the barrier drains the ring, it is guarded by the ctx lock
+		drain bool
+		// onComplete and dispatched are guarded by the ctx lock
+		onComplete func(Completion)
+		dispatched bool
+	}
+)
+
+func newOp(f *File, kind int, buf []uint8, off int64) *Op {
+	return &Op{
+		c:       f.ctx,
+		f:       f,
+		kind:    kind,
+		buf:     buf,
+		off:     off,
+		done:    make(chan struct{}),
+		timeout: time.Duration(atomic.LoadInt64(&f.timeout)),
+	}
+}
+
+// newCtxOp makes an operation of the context which isn't bound to a file
+func newCtxOp(c *ctx, kind int) *Op {
+	return &Op{
+		c:    c,
+		kind: kind,
+		done: make(chan struct{}),
+	}
+}
+
+// Done reports whether the operation has been completed
+func (o *Op) Done() bool {
+	if o.isDone() {
+		return true
+	}
+	_ = o.poll()
+	return o.isDone()
+}
+
+// Wait waits until the operation is completed or the timeout expires.
+// A negative timeout waits indefinitely. ErrNotCompleted is returned if the timeout has expired.
+func (o *Op) Wait(timeout time.Duration) error {
+	if o.Done() {
+		return nil
+	}
+	return o.c.waitFor(context.Background(), o.isDone, timeout)
+}
+
+// WaitContext blocks until the operation is completed or cx is done.
+// If cx is done first, the operation is cancelled and awaited, so the kernel doesn't touch the buffer after the return,
+// and the error of cx is returned. If the operation can't be cancelled, it is completed as usual and nil is returned.
+func (o *Op) WaitContext(cx context.Context) error {
+	if o.Done() {
+		return nil
+	}
+	err := o.c.waitFor(cx, o.isDone, -1)
+	if err == nil || err != cx.Err() {
+		return err
+	}
+	_ = o.Cancel()
+	if err := o.Wait(-1); err != nil {
+		return err
+	}
+	if o.err != syscall.ECANCELED {
+		return nil
+	}
+	return err
+}
+
+func (o *Op) isDone() bool {
+	select {
+	case <-o.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Result returns the number of processed bytes.
+// ErrNotCompleted is returned while the operation is in flight, ErrEOF - if a read hits the end of file.
+func (o *Op) Result() (int, error) {
+	if !o.Done() {
+		return 0, ErrNotCompleted
+	}
+	if o.err != nil {
+		return 0, o.err
+	}
+	return int(o.result), nil
+}
+
+// Buffer returns the buffer of the operation, it is nil for the vectored operations
+func (o *Op) Buffer() []uint8 {
+	if o.bufs != nil {
+		return nil
+	}
+	return o.buf
+}
+
+// Buffers returns the buffers of the operation
+func (o *Op) Buffers() [][]uint8 {
+	if o.bufs != nil {
+		return o.bufs
+	}
+	return [][]uint8{o.buf}
+}
+
+// Offset returns the file offset of the operation
+func (o *Op) Offset() int64 {
+	return o.off
+}
+
+// File returns the file of the operation, it is nil for a barrier and the operations on the paths.
+// The file of OpenAsync can be used once the operation is completed successfully
+func (o *Op) File() *File {
+	return o.f
+}
+
+// setResult stores the raw result of the kernel: the number of bytes or -errno
+func (o *Op) setResult(res int64) {
+	o.result = res
+	if res < 0 {
+		o.err = syscall.Errno(-res)
+	}
+}
+
+// complete publishes the result of the operation, it must be called once without the ctx lock
+func (o *Op) complete() {
+	if o.err == nil && o.kind == OpRead && o.result == 0 && o.size() > 0 {
+		o.err = ErrEOF
+	}
+	if o.err == syscall.ECANCELED && o.timeout > 0 && atomic.LoadInt32(&o.cancelled) == 0 {
+		o.err = ErrTimeout
+	}
+	if o.bufs != nil && o.buf != nil && o.kind == OpRead && o.result > 0 {
+		// the vectored read has been done into the gathered buffer
+		scatter(o.buf[:o.result], o.bufs)
+	}
+	if o.cursor {
+		f := o.f
+		f.mtx.Lock()
+		if o.kind == OpRead {
+			f.lastAsyncOpState.data = o.buf
+			f.lastAsyncOpState.eof = o.size() > 0 && o.result == 0
+		}
+		f.lastAsyncOpState.result = o.result
+		f.pos = o.off
+		if o.result > 0 {
+			f.pos += o.result
+		}
+		f.lastAsyncOpState.complete = true
+		f.mtx.Unlock()
+	}
+	close(o.done)
+}
+
+// Cancel asks the kernel to cancel the operation, it doesn't wait for the operation to complete.
+// The cancelled operation is completed with ECANCELED. If it is already running and can't be stopped,
+// ErrNotCancelled is returned and the operation is completed as usual. A barrier can't be cancelled.
+// The operations done by the goroutines can't be cancelled except SendTo, see its doc.
+func (o *Op) Cancel() error {
+	if o.isDone() {
+		return nil
+	}
+	if o.kind == OpBarrier {
+		return ErrNotCancelled
+	}
+	atomic.StoreInt32(&o.cancelled, 1)
+	if o.c.abortOffloaded(o) {
+		return nil
+	}
+	return o.c.cancel(o)
+}
+
+// armTimers cancels the operations from userspace once their timeouts expire,
+// it is used by the backends which can't link a timeout to the operation in the kernel.
+// A failed cancellation is ignored, the operation is completed as usual then
+func (c *ctx) armTimers(ops ...*Op) {
+	c.Lock()
+	defer c.Unlock()
+	for _, o := range ops {
+		if o.timeout <= 0 || o.internal || o.isDone() {
+			continue
+		}
+		o := o
+		o.timer = time.AfterFunc(o.timeout, func() {
+			if !o.isDone() {
+				_ = c.cancel(o)
+			}
+		})
+	}
+}
+
+// CancelAll cancels all the operations of the file in flight.
+// ErrNotCancelled is returned if some of them can't be cancelled,
+// the operations done by the goroutines can't be cancelled except SendTo.
+func (f *File) CancelAll() error {
+	c := f.ctx
+	c.Lock()
+	var ops []*Op
+	for _, o := range c.operationsFd {
+		if o.f == f && !o.internal {
+			ops = append(ops, o)
+		}
+	}
+	for o := range c.offloading {
+		if o.f == f && !o.internal {
+			ops = append(ops, o)
+		}
+	}
+	c.Unlock()
+
+	var err error
+	for _, o := range ops {
+		if e := o.Cancel(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// size returns the number of bytes to transfer
+func (o *Op) size() int {
+	if o.bufs == nil {
+		return len(o.buf)
+	}
+	var sz int
+	for _, b := range o.bufs {
+		sz += len(b)
+	}
+	return sz
+}
+
+func (f *File) ReadAsync(b []uint8) (*Op, error) {
+	return f.submitAtCursor(newOp(f, OpRead, b, 0))
+}
+
+func (f *File) WriteAsync(b []uint8) (*Op, error) {
+	return f.submitAtCursor(newOp(f, OpWrite, b, 0))
+}
+
+// ReadAtAsync submits a read at the offset, the position of the file isn't changed
+func (f *File) ReadAtAsync(b []uint8, off int64) (*Op, error) {
+	return f.submitAt(newOp(f, OpRead, b, off))
+}
+
+// WriteAtAsync submits a write at the offset, the position of the file isn't changed
+func (f *File) WriteAtAsync(b []uint8, off int64) (*Op, error) {
+	return f.submitAt(newOp(f, OpWrite, b, off))
+}
+
+// ReadvAsync submits a read into many buffers at the current position
+func (f *File) ReadvAsync(bufs [][]uint8) (*Op, error) {
+	return f.submitAtCursor(f.newVecOp(OpRead, bufs, 0))
+}
+
+// WritevAsync submits a write from many buffers at the current position
+func (f *File) WritevAsync(bufs [][]uint8) (*Op, error) {
+	return f.submitAtCursor(f.newVecOp(OpWrite, bufs, 0))
+}
+
+// ReadvAtAsync submits a read into many buffers at the offset, the position of the file isn't changed
+func (f *File) ReadvAtAsync(bufs [][]uint8, off int64) (*Op, error) {
+	return f.submitAt(f.newVecOp(OpRead, bufs, off))
+}
+
+// WritevAtAsync submits a write from many buffers at the offset, the position of the file isn't changed
+func (f *File) WritevAtAsync(bufs [][]uint8, off int64) (*Op, error) {
+	return f.submitAt(f.newVecOp(OpWrite, bufs, off))
+}
+
+// SyncAsync submits fsync of the file
+func (f *File) SyncAsync() (*Op, error) {
+	return f.submitSync(OpSync)
+}
+
+// DatasyncAsync submits fdatasync of the file: the metadata isn't flushed unless it is needed to read the data
+func (f *File) DatasyncAsync() (*Op, error) {
+	return f.submitSync(OpDatasync)
+}
+
+func (f *File) submitSync(kind int) (*Op, error) {
+	return f.submitAt(newOp(f, kind, nil, 0))
+}
+
+// newVecOp makes the vectored operation.
+// If the platform or the mode of the file can't do it natively, the buffers are gathered into one.
+func (f *File) newVecOp(kind int, bufs [][]uint8, off int64) *Op {
+	o := newOp(f, kind, nil, off)
+	if bufs == nil {
+		bufs = [][]uint8{}
+	}
+	o.bufs = bufs
+	if nativeVectored && f.Mode() == ModeAsync {
+		return o
+	}
+	o.buf = make([]uint8, o.size())
+	if kind == OpWrite {
+		gather(o.buf, bufs)
+	}
+	return o
+}
+
+func gather(dst []uint8, bufs [][]uint8) {
+	for _, b := range bufs {
+		dst = dst[copy(dst, b):]
+	}
+}
+
+func scatter(src []uint8, bufs [][]uint8) {
+	for _, b := range bufs {
+		if len(src) == 0 {
+			return
+		}
+		src = src[copy(b, src):]
+	}
+}
+
+// immediate reports whether the operation is done in place: the file is synchronous or there is nothing to transfer
+func (o *Op) immediate() bool {
+	if o.f == nil {
+		// the operations on the paths are always asynchronous
+		return false
+	}
+	if o.f.Mode() == ModeSync {
+		return true
+	}
+	return (o.kind == OpRead || o.kind == OpWrite) && o.size() == 0
+}
+
+// doImmediate does the operation in place and completes it
+func (f *File) doImmediate(o *Op) {
+	o.result, o.err = f.doSync(o)
+	f.ctx.completeOps([]*Op{o})
+}
+
+// doSync does the operation with the synchronous calls, a vectored operation is gathered into one buffer
+func (f *File) doSync(o *Op) (int64, error) {
+	switch o.kind {
+	case OpRead, OpWrite:
+		if o.size() == 0 {
+			return 0, nil
+		}
+		if o.buf == nil {
+			// it is scattered by complete
+			o.buf = make([]uint8, o.size())
+			if o.kind == OpWrite {
+				gather(o.buf, o.bufs)
+			}
+		}
+		var n int
+		var err error
+		if o.kind == OpRead {
+			n, err = f.readAtSync(o.buf, o.off)
+		} else {
+			n, err = f.writeAtSync(o.buf, o.off)
+		}
+		if err == ErrEOF && n > 0 {
+			// a short read, the next one gets EOF
+			err = nil
+		}
+		return int64(n), err
+	case OpSync, OpDatasync:
+		return 0, f.fd.Sync()
+	case OpAllocate:
+		return 0, f.allocateSync(o.off, o.length, o.mode)
+	case OpTruncate:
+		return 0, f.fd.Truncate(o.off)
+	case OpOpen:
+		if err := f.openFd(o.flag, os.FileMode(o.mode)); err != nil {
+			return 0, err
+		}
+		return int64(f.fd.Fd()), nil
+	case OpClose:
+		return 0, f.close()
+	case OpStat:
+		st, err := f.fd.Stat()
+		o.info = st
+		return 0, err
+	default:
+		return 0, ErrUnknownOperation
+	}
+}
+
+func (f *File) submitAt(o *Op) (*Op, error) {
+	if o.immediate() {
+		f.doImmediate(o)
+		return o, nil
+	}
+	if f.ctx.gate([]*Op{o}, func() { f.startOrFail(o) }) {
+		return o, nil
+	}
+	if err := f.submit(o); err != nil {
+		f.ctx.ungate([]*Op{o})
+		return nil, err
+	}
+	runtime.KeepAlive(f)
+	return o, nil
+}
+
+// legacyPendingLocked reports whether the operation of Read or Write is in flight, the file lock must be held
+func (f *File) legacyPendingLocked() bool {
+	return f.lastAsyncOpState.lastOp != OpUnknown && !f.lastAsyncOpState.complete
+}
+
+// pollLegacy fills the state of the operation of Read or Write if it is in flight
+func (f *File) pollLegacy() {
+	f.mtx.Lock()
+	pending := f.legacyPendingLocked()
+	f.mtx.Unlock()
+	if pending {
+		_ = f.checkAsyncResult()
+	}
+}
+
+// submitAtCursor submits the operation at the current position.
+// The position is advanced by the size of the operation at submission, so the following operations don't overlap.
+// Read and Write move the position once they are completed instead, so ErrNotCompleted is returned while one of them is in flight.
+func (f *File) submitAtCursor(o *Op) (*Op, error) {
+	if f.Mode() == ModeSync {
+		o.off = f.pos
+		var n int
+		var err error
+		if o.kind == OpRead {
+			n, err = f.readSync(o.buf)
+		} else {
+			n, err = f.writeSync(o.buf)
+		}
+		o.result = int64(n)
+		o.err = err
+		f.ctx.completeOps([]*Op{o})
+		return o, nil
+	}
+
+	f.pollLegacy()
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.legacyPendingLocked() {
+		// the range of the operation isn't known until it is completed
+		return nil, ErrNotCompleted
+	}
+	o.off = f.pos
+	sz := o.size()
+	if sz == 0 {
+		f.ctx.completeOps([]*Op{o})
+		return o, nil
+	}
+	if f.ctx.gate([]*Op{o}, func() { f.startOrFail(o) }) {
+		f.lastSyncSeek = true
+		f.pos += int64(sz)
+		return o, nil
+	}
+	if err := f.submit(o); err != nil {
+		f.ctx.ungate([]*Op{o})
+		return nil, err
+	}
+	f.lastSyncSeek = true
+	f.pos += int64(sz)
+	runtime.KeepAlive(f)
+	return o, nil
+}
@@ -0,0 +1,389 @@
+package asyncfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func waitOp(t *testing.T, o *Op) {
+	t1 := time.Now()
+	for !o.Done() {
+		if time.Now().Sub(t1) > time.Second {
+			t.Fatal("too long")
+		}
+	}
+}
+
+func TestOp_Async(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./opAsync"
+			f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			const chunks = 4
+			const sz = 1024
+			ops := make([]*Op, 0, chunks)
+			for i := 0; i < chunks; i++ {
+				buf := AllocBuf(sz)
+				for j := range buf {
+					buf[j] = uint8(i + 1)
+				}
+				o, err := f.WriteAsync(buf)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(i*sz), o.Offset())
+				ops = append(ops, o)
+			}
+			assert.Equal(t, int64(chunks*sz), f.pos)
+
+			for i, o := range ops {
+				waitOp(t, o)
+				n, err := o.Result()
+				assert.NoError(t, err)
+				assert.Equal(t, sz, n)
+				assert.Equal(t, uint8(i+1), o.Buffer()[0])
+				assert.Equal(t, f, o.File())
+			}
+
+			_, err = f.Seek(0, 0)
+			assert.NoError(t, err)
+			ops = ops[:0]
+			for i := 0; i < chunks+1; i++ {
+				o, err := f.ReadAsync(AllocBuf(sz))
+				assert.NoError(t, err)
+				ops = append(ops, o)
+			}
+			for i, o := range ops {
+				waitOp(t, o)
+				n, err := o.Result()
+				if i == chunks {
+					assert.EqualError(t, err, ErrEOF.Error())
+					assert.Equal(t, 0, n)
+					continue
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, sz, n)
+				for _, b := range o.Buffer() {
+					assert.Equal(t, uint8(i+1), b)
+				}
+			}
+		}()
+	}
+}
+
+func TestOp_Sync(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./opSync"
+			f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeSync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			o, err := f.WriteAsync([]uint8("sync"))
+			assert.NoError(t, err)
+			assert.True(t, o.Done())
+			n, err := o.Result()
+			assert.NoError(t, err)
+			assert.Equal(t, 4, n)
+
+			o, err = f.ReadAsync(make([]uint8, 4))
+			assert.NoError(t, err)
+			_, err = o.Result()
+			assert.EqualError(t, err, ErrEOF.Error())
+		}()
+	}
+}
+
+func TestOp_Wait(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./opWait"
+			f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			const chunks = 4
+			const sz = 4096
+			ops := make([]*Op, 0, chunks)
+			for i := 0; i < chunks; i++ {
+				o, err := f.WriteAsync(AllocBuf(sz))
+				assert.NoError(t, err)
+				ops = append(ops, o)
+			}
+
+			done := make(chan error, chunks)
+			for _, o := range ops {
+				go func(o *Op) {
+					done <- o.Wait(time.Second)
+				}(o)
+			}
+			for range ops {
+				assert.NoError(t, <-done)
+			}
+			for _, o := range ops {
+				n, err := o.Result()
+				assert.NoError(t, err)
+				assert.Equal(t, sz, n)
+			}
+
+			_, err = f.Seek(0, 0)
+			assert.NoError(t, err)
+			_, err = f.Read(AllocBuf(sz))
+			assert.NoError(t, err)
+			n, err := f.Wait(time.Second)
+			assert.NoError(t, err)
+			assert.Equal(t, sz, n)
+
+			_, err = f.Seek(0, 0)
+			assert.NoError(t, err)
+			for i := 0; i < chunks; i++ {
+				_, err := f.ReadAsync(AllocBuf(sz))
+				assert.NoError(t, err)
+			}
+			cnt, err := WaitAny(chunks, time.Second)
+			assert.NoError(t, err)
+			assert.True(t, cnt >= chunks)
+		}()
+	}
+}
+
+func TestOp_Wait_timeout(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		t1 := time.Now()
+		n, err := WaitAny(1, 20*time.Millisecond)
+		assert.EqualError(t, err, ErrNotCompleted.Error())
+		assert.Equal(t, 0, n)
+		assert.True(t, time.Since(t1) >= 20*time.Millisecond)
+	}
+}
+
+func TestOp_At(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		for _, mode := range []uint8{ModeAsync, ModeSync} {
+			func() {
+				path := "./opAt"
+				f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, mode)
+				assert.NoError(t, err)
+				defer func() {
+					f.Close()
+					os.Remove(f.path)
+				}()
+
+				const chunks = 4
+				const sz = 4096
+				ops := make([]*Op, 0, chunks)
+				// in the reverse order, the operations don't depend on the position
+				for i := chunks - 1; i >= 0; i-- {
+					buf := AllocBuf(sz)
+					for j := range buf {
+						buf[j] = uint8(i + 1)
+					}
+					o, err := f.WriteAtAsync(buf, int64(i*sz))
+					assert.NoError(t, err)
+					assert.Equal(t, int64(i*sz), o.Offset())
+					ops = append(ops, o)
+				}
+				for _, o := range ops {
+					assert.NoError(t, o.Wait(time.Second))
+					n, err := o.Result()
+					assert.NoError(t, err)
+					assert.Equal(t, sz, n)
+				}
+				assert.Equal(t, int64(0), f.Pos())
+
+				ops = ops[:0]
+				for i := 0; i < chunks; i++ {
+					o, err := f.ReadAtAsync(AllocBuf(sz), int64(i*sz))
+					assert.NoError(t, err)
+					ops = append(ops, o)
+				}
+				for i, o := range ops {
+					assert.NoError(t, o.Wait(time.Second))
+					n, err := o.Result()
+					assert.NoError(t, err)
+					assert.Equal(t, sz, n)
+					assert.Equal(t, uint8(i+1), o.Buffer()[0])
+					assert.Equal(t, uint8(i+1), o.Buffer()[sz-1])
+				}
+
+				buf := AllocBuf(sz)
+				n, err := f.ReadAt(buf, 2*sz)
+				assert.NoError(t, err)
+				assert.Equal(t, sz, n)
+				assert.Equal(t, uint8(3), buf[0])
+				n, err = f.WriteAt(buf, chunks*sz)
+				assert.NoError(t, err)
+				assert.Equal(t, sz, n)
+				n, err = f.ReadAt(buf, (chunks+1)*sz)
+				assert.EqualError(t, err, ErrEOF.Error())
+				assert.Equal(t, 0, n)
+				// the read crossing the end returns what is before it
+				n, err = f.ReadAt(AllocBuf(2*sz), chunks*sz)
+				assert.EqualError(t, err, ErrEOF.Error())
+				assert.Equal(t, sz, n)
+				assert.Equal(t, int64(0), f.Pos())
+			}()
+		}
+	}
+}
+
+func TestOp_Cursor_legacy(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./opCursor"
+			f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			const sz = 4096
+			a := AllocBuf(sz)
+			b := AllocBuf(sz)
+			for i := range a {
+				a[i] = 1
+				b[i] = 2
+			}
+			_, err = f.Write(a)
+			assert.NoError(t, err)
+			// the position is moved by Write once it is completed, so WriteAsync doesn't take the same range
+			var o *Op
+			t1 := time.Now()
+			for {
+				o, err = f.WriteAsync(b)
+				if err != ErrNotCompleted {
+					break
+				}
+				if time.Now().Sub(t1) > time.Second {
+					t.Fatal("too long")
+				}
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, int64(sz), o.Offset())
+			assert.NoError(t, o.Wait(time.Second))
+			assert.Equal(t, int64(2*sz), f.Pos())
+
+			out := AllocBuf(2 * sz)
+			n, err := f.ReadAt(out, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, 2*sz, n)
+			assert.Equal(t, uint8(1), out[sz-1])
+			assert.Equal(t, uint8(2), out[sz])
+		}()
+	}
+}
+
+func TestOp_Vectored(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		for _, mode := range []uint8{ModeAsync, ModeSync} {
+			func() {
+				path := "./opVectored"
+				f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, mode)
+				assert.NoError(t, err)
+				defer func() {
+					f.Close()
+					os.Remove(f.path)
+				}()
+
+				fill := func(b []uint8, v uint8) []uint8 {
+					for i := range b {
+						b[i] = v
+					}
+					return b
+				}
+				header := fill(AllocBuf(512), 1)
+				payload := fill(AllocBuf(2048), 2)
+				o, err := f.WritevAsync([][]uint8{header, payload})
+				assert.NoError(t, err)
+				assert.NoError(t, o.Wait(time.Second))
+				n, err := o.Result()
+				assert.NoError(t, err)
+				assert.Equal(t, 2560, n)
+				assert.Equal(t, [][]uint8{header, payload}, o.Buffers())
+				assert.Nil(t, o.Buffer())
+
+				o, err = f.WritevAtAsync([][]uint8{fill(AllocBuf(512), 3), {}, fill(AllocBuf(512), 4)}, 2560)
+				assert.NoError(t, err)
+				assert.NoError(t, o.Wait(time.Second))
+				n, err = o.Result()
+				assert.NoError(t, err)
+				assert.Equal(t, 1024, n)
+				assert.Equal(t, int64(2560), f.Pos())
+
+				bufs := [][]uint8{AllocBuf(1024), AllocBuf(2048), AllocBuf(512)}
+				o, err = f.ReadvAtAsync(bufs, 512)
+				assert.NoError(t, err)
+				assert.NoError(t, o.Wait(time.Second))
+				n, err = o.Result()
+				assert.NoError(t, err)
+				assert.Equal(t, 3072, n)
+				assert.Equal(t, fill(make([]uint8, 1024), 2), bufs[0])
+				assert.Equal(t, append(fill(make([]uint8, 1024), 2), append(fill(make([]uint8, 512), 3), fill(make([]uint8, 512), 4)...)...), bufs[1])
+				assert.Equal(t, make([]uint8, 512), bufs[2])
+
+				_, err = f.Seek(0, 0)
+				assert.NoError(t, err)
+				o, err = f.ReadvAsync([][]uint8{AllocBuf(512), AllocBuf(512)})
+				assert.NoError(t, err)
+				assert.NoError(t, o.Wait(time.Second))
+				n, err = o.Result()
+				assert.NoError(t, err)
+				assert.Equal(t, 1024, n)
+				assert.Equal(t, header, o.Buffers()[0])
+				assert.Equal(t, int64(1024), f.Pos())
+			}()
+		}
+	}
+}
+
+func TestOp_Fsync(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		for _, mode := range []uint8{ModeAsync, ModeSync} {
+			func() {
+				path := "./opFsync"
+				f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, mode)
+				assert.NoError(t, err)
+				defer func() {
+					f.Close()
+					os.Remove(f.path)
+				}()
+
+				o, err := f.WriteAtAsync(AllocBuf(4096), 0)
+				assert.NoError(t, err)
+				assert.NoError(t, o.Wait(time.Second))
+
+				for _, sync := range []func() (*Op, error){f.SyncAsync, f.DatasyncAsync} {
+					o, err := sync()
+					assert.NoError(t, err)
+					assert.NoError(t, o.Wait(time.Second))
+					n, err := o.Result()
+					assert.NoError(t, err)
+					assert.Equal(t, 0, n)
+				}
+				assert.NoError(t, f.Sync())
+			}()
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// +build 386 arm armbe mips mipsle ppc s390 sparc
+// +build linux android freebsd darwin
+
+package asyncfs
+
+import (
+	"syscall"
+)
+
+// rawPread reads at off, the 32-bit ABIs pass the offset in the register pairs of their own,
+// so it is left to the syscall package
+func rawPread(fd int, data []uint8, off int64) (int, error) {
+	return syscall.Pread(fd, data, off)
+}
+
+// rawPwrite writes at off, see rawPread
+func rawPwrite(fd int, data []uint8, off int64) (int, error) {
+	return syscall.Pwrite(fd, data, off)
+}
@@ -0,0 +1,27 @@
+// +build amd64 amd64p32 arm64 arm64be ppc64 ppc64le mips64 mips64le mips64p32 mips64p32le s390x sparc64
+// +build linux android freebsd darwin
+
+package asyncfs
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// rawPread reads at off with RawSyscall, so the goroutine doesn't leave the thread like readSync with SYS_READ
+func rawPread(fd int, data []uint8, off int64) (int, error) {
+	nn, _, e := syscall.RawSyscall6(sysPread, uintptr(fd), uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(off), 0, 0)
+	if e != 0 {
+		return 0, e
+	}
+	return int(nn), nil
+}
+
+// rawPwrite writes at off with RawSyscall, see rawPread
+func rawPwrite(fd int, data []uint8, off int64) (int, error) {
+	nn, _, e := syscall.RawSyscall6(sysPwrite, uintptr(fd), uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(off), 0, 0)
+	if e != 0 {
+		return 0, e
+	}
+	return int(nn), nil
+}
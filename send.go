@@ -0,0 +1,70 @@
+package asyncfs
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SendTo submits the transfer of n bytes of the file at off into the socket or the pipe.
+// io_uring splices the data through a pipe (IORING_OP_SPLICE), so it isn't copied to user space and no thread is blocked;
+// the other backends copy it through an aligned buffer. The result is the number of the sent bytes,
+// it is less than n if the file ends earlier; nothing is sent if n isn't positive.
+// conn must not be closed until the operation is completed. If conn has SetWriteDeadline,
+// Cancel and Ctx.Close interrupt the blocked send by moving the write deadline to the past,
+// the deadline is cleared afterwards; the interrupted operation is completed with ECANCELED or ErrCtxClosed.
+func (f *File) SendTo(conn syscall.Conn, off, n int64) (*Op, error) {
+	if off < 0 {
+		return nil, ErrNegativeOffset
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	o := newOp(f, OpSend, nil, off)
+	o.length = n
+	if n <= 0 {
+		f.ctx.completeOps([]*Op{o})
+		return o, nil
+	}
+	var aborted int32
+	d, _ := conn.(interface {
+		SetWriteDeadline(time.Time) error
+	})
+	if d != nil {
+		o.abort = func() {
+			atomic.StoreInt32(&aborted, 1)
+			_ = d.SetWriteDeadline(time.Unix(1, 0))
+		}
+	}
+	start := func() error {
+		return f.ctx.offload(o, func() (int64, error) {
+			sent, err := f.sendTo(rc, off, n)
+			if atomic.LoadInt32(&aborted) == 0 {
+				return sent, err
+			}
+			_ = d.SetWriteDeadline(time.Time{})
+			if err == nil {
+				return sent, nil
+			}
+			if atomic.LoadInt32(&o.cancelled) == 1 {
+				return sent, syscall.ECANCELED
+			}
+			return sent, ErrCtxClosed
+		})
+	}
+	held := f.ctx.gate([]*Op{o}, func() {
+		if err := start(); err != nil {
+			o.err = err
+			f.ctx.completeOps([]*Op{o})
+		}
+	})
+	if held {
+		return o, nil
+	}
+	if err := start(); err != nil {
+		f.ctx.ungate([]*Op{o})
+		return nil, err
+	}
+	return o, nil
+}
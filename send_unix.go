@@ -0,0 +1,47 @@
+// +build linux android freebsd darwin
+
+package asyncfs
+
+import (
+	"io"
+	"syscall"
+)
+
+// sendRW copies the range into the descriptor of rc through the buffer of the context,
+// the goroutine is parked by the netpoller while the socket is full
+func (f *File) sendRW(rc syscall.RawConn, off, n int64) (int64, error) {
+	buf := f.ctx.chunkBuf(n)
+	defer f.ctx.releaseBuf(buf)
+
+	r := f.Blocking()
+	var done int64
+	for done < n {
+		p := buf
+		if left := n - done; left < int64(len(p)) {
+			p = p[:left]
+		}
+		k, err := r.ReadAt(p, off+done)
+		for w := 0; w < k; {
+			var m int
+			var werr error
+			if err := rc.Write(func(fd uintptr) bool {
+				m, werr = syscall.Write(int(fd), p[w:k])
+				return werr != syscall.EAGAIN
+			}); err != nil {
+				return done, err
+			}
+			if werr != nil {
+				return done, werr
+			}
+			w += m
+			done += int64(m)
+		}
+		if err == io.EOF {
+			return done, nil
+		}
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
@@ -0,0 +1,58 @@
+// +build linux android
+
+package asyncfs
+
+import (
+	"io"
+	"syscall"
+)
+
+// sendTo splices the range into the descriptor of rc through a pipe,
+// it is copied through user space if the ring can't splice
+func (f *File) sendTo(rc syscall.RawConn, off, n int64) (int64, error) {
+	c := f.ctx
+	if c.asyncMode != asyncIoUring || c.iopoll || !c.supports(ioringOpSplice) {
+		return f.sendRW(rc, off, n)
+	}
+	p, chunk, err := newSplicePipe()
+	if err != nil {
+		return 0, err
+	}
+	defer closePipe(p)
+
+	var done int64
+	for done < n {
+		k := n - done
+		if k > chunk {
+			k = chunk
+		}
+		k, err := c.splice(int(f.fd.Fd()), off+done, p[1], -1, k)
+		if err != nil {
+			return done, err
+		}
+		if k == 0 {
+			// the end of the file
+			return done, nil
+		}
+		for k > 0 {
+			// the socket is non-blocking, so the splice is repeated once the netpoller reports it writable
+			var m int64
+			var serr error
+			if err := rc.Write(func(fd uintptr) bool {
+				m, serr = c.splice(p[0], -1, int(fd), -1, k)
+				return serr != syscall.EAGAIN
+			}); err != nil {
+				return done, err
+			}
+			if serr != nil {
+				return done, serr
+			}
+			if m == 0 {
+				return done, io.ErrShortWrite
+			}
+			done += m
+			k -= m
+		}
+	}
+	return done, nil
+}
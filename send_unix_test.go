@@ -0,0 +1,188 @@
+// +build linux android freebsd darwin
+
+package asyncfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFile_SendTo(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			f, err := Open("./send_src", syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			const sz = 300*1024 + 100
+			data := make([]uint8, sz)
+			for i := range data {
+				data[i] = uint8(i * 7)
+			}
+			_, err = f.Blocking().WriteAt(data, 0)
+			assert.NoError(t, err)
+
+			fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+			assert.NoError(t, err)
+			conn := func(fd int) net.Conn {
+				fl := os.NewFile(uintptr(fd), "")
+				defer fl.Close()
+				c, err := net.FileConn(fl)
+				assert.NoError(t, err)
+				return c
+			}
+			w, r := conn(fds[0]), conn(fds[1])
+			defer w.Close()
+			defer r.Close()
+
+			// the file is larger than the socket buffer, so the sender waits for the reader
+			got := make(chan []uint8, 1)
+			go func() {
+				buf, _ := ioutil.ReadAll(r)
+				got <- buf
+			}()
+
+			send := func(off, n int64) {
+				o, err := f.SendTo(w.(syscall.Conn), off, n)
+				assert.NoError(t, err)
+				assert.NoError(t, o.Wait(-1))
+				assert.Equal(t, OpSend, o.kind)
+				k, err := o.Result()
+				assert.NoError(t, err)
+				assert.Equal(t, int(n), k)
+			}
+			send(0, 5000)
+			send(5000, sz-5000)
+
+			// the file ends earlier
+			o, err := f.SendTo(w.(syscall.Conn), sz-10, 100)
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(-1))
+			k, err := o.Result()
+			assert.NoError(t, err)
+			assert.Equal(t, 10, k)
+
+			w.(*net.UnixConn).CloseWrite()
+			assert.Equal(t, append(append([]uint8{}, data...), data[sz-10:]...), <-got)
+
+			// nothing to send
+			for _, n := range []int64{0, -1} {
+				o, err := f.SendTo(w.(syscall.Conn), 0, n)
+				assert.NoError(t, err)
+				assert.True(t, o.Done())
+				k, err := o.Result()
+				assert.NoError(t, err)
+				assert.Equal(t, 0, k)
+			}
+
+			_, err = f.SendTo(w.(syscall.Conn), -1, 1)
+			assert.Equal(t, ErrNegativeOffset, err)
+		}()
+	}
+}
+
+func TestFile_SendTo_blocked(t *testing.T) {
+	grace := closeGrace
+	closeGrace = 100 * time.Millisecond
+	defer func() {
+		closeGrace = grace
+	}()
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			f, err := Open("./send_src", syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+			const sz = 4 << 20
+			_, err = f.Blocking().WriteAt(make([]uint8, sz), 0)
+			assert.NoError(t, err)
+
+			fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+			assert.NoError(t, err)
+			conn := func(fd int) net.Conn {
+				fl := os.NewFile(uintptr(fd), "")
+				defer fl.Close()
+				c, err := net.FileConn(fl)
+				assert.NoError(t, err)
+				return c
+			}
+			// nobody reads, so the send is blocked once the socket buffer is full
+			w, r := conn(fds[0]), conn(fds[1])
+			defer w.Close()
+			defer r.Close()
+
+			o, err := f.SendTo(w.(syscall.Conn), 0, sz)
+			assert.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+			assert.NoError(t, o.Cancel())
+			assert.NoError(t, o.Wait(-1))
+			_, err = o.Result()
+			assert.Equal(t, syscall.ECANCELED, err)
+
+			// CancelAll reaches the sends done by the goroutines
+			o, err = f.SendTo(w.(syscall.Conn), 0, sz)
+			assert.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+			assert.NoError(t, f.CancelAll())
+			assert.NoError(t, o.Wait(-1))
+			_, err = o.Result()
+			assert.Equal(t, syscall.ECANCELED, err)
+
+			// the send can't be interrupted without SetWriteDeadline
+			type rawConn struct {
+				syscall.Conn
+			}
+			fds, err = syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+			assert.NoError(t, err)
+			w2, r2 := conn(fds[0]), conn(fds[1])
+			defer w2.Close()
+			defer r2.Close()
+			o, err = f.SendTo(rawConn{w2.(syscall.Conn)}, 0, sz)
+			assert.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+			assert.Equal(t, ErrNotCancelled, f.CancelAll())
+			go io.Copy(ioutil.Discard, r2)
+			assert.NoError(t, o.Wait(-1))
+			k, err := o.Result()
+			assert.NoError(t, err)
+			assert.Equal(t, sz, k)
+
+			o, err = f.SendTo(w.(syscall.Conn), 0, sz)
+			assert.NoError(t, err)
+			closed := make(chan error, 1)
+			go func() {
+				closed <- c.close()
+			}()
+			select {
+			case err = <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("close is blocked by the pending send")
+			}
+			if err != nil {
+				// close may catch the send reading the file, nothing is stuck though
+				pending, ok := err.(*PendingOpsError)
+				assert.True(t, ok)
+				if ok {
+					assert.Empty(t, pending.Ops)
+				}
+			}
+			assert.True(t, o.Done())
+			_, err = o.Result()
+			assert.Equal(t, ErrCtxClosed, err)
+			c = nil
+		}()
+	}
+}
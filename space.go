@@ -0,0 +1,69 @@
+package asyncfs
+
+// The modes of Allocate, they are the flags of fallocate(2)
+const (
+	// FallocKeepSize allocates the space beyond the end of the file without changing its size
+	FallocKeepSize = 0x1
+	// FallocPunchHole deallocates the range, it must be combined with FallocKeepSize
+	FallocPunchHole = 0x2
+	// FallocZeroRange zeroes the range allocating it if needed
+	FallocZeroRange = 0x10
+)
+
+// Allocate allocates the space of the range, the goroutine is parked until it is done.
+// Only the zero mode is supported outside of linux, it extends the file if needed
+func (f *File) Allocate(off, length int64, mode uint32) error {
+	return f.waitErr(f.AllocateAsync(off, length, mode))
+}
+
+// AllocateAsync submits fallocate of the range, io_uring does IORING_OP_FALLOCATE, the other backends do it on a goroutine
+func (f *File) AllocateAsync(off, length int64, mode uint32) (*Op, error) {
+	if off < 0 || length < 0 {
+		return nil, ErrNegativeOffset
+	}
+	o := newOp(f, OpAllocate, nil, off)
+	o.length = length
+	o.mode = mode
+	return f.submitAt(o)
+}
+
+// Truncate changes the size of the file, the goroutine is parked until it is done
+func (f *File) Truncate(size int64) error {
+	return f.waitErr(f.TruncateAsync(size))
+}
+
+// TruncateAsync submits ftruncate of the file, io_uring does IORING_OP_FTRUNCATE if the kernel has it,
+// otherwise it is done on a goroutine
+func (f *File) TruncateAsync(size int64) (*Op, error) {
+	if size < 0 {
+		return nil, ErrNegativeOffset
+	}
+	return f.submitAt(newOp(f, OpTruncate, nil, size))
+}
+
+// waitErr waits for the submitted operation and returns its error
+func (f *File) waitErr(o *Op, err error) error {
+	if err != nil {
+		return err
+	}
+	if err := o.Wait(-1); err != nil {
+		return err
+	}
+	_, err = o.Result()
+	return err
+}
+
+// extend emulates fallocate with the zero mode: the file is extended to the end of the range
+func (f *File) extend(off, length int64, mode uint32) error {
+	if mode != 0 {
+		return ErrNotSupported
+	}
+	st, err := f.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() >= off+length {
+		return nil
+	}
+	return f.fd.Truncate(off + length)
+}
@@ -0,0 +1,71 @@
+package asyncfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFile_Allocate(t *testing.T) {
+	for _, x := range steps() {
+		prepare(t, x)
+		func() {
+			path := "./allocate"
+			f, err := Open(path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC, 0644, ModeAsync)
+			assert.NoError(t, err)
+			defer func() {
+				f.Close()
+				os.Remove(f.path)
+			}()
+
+			const sz = 1 << 20
+			assert.NoError(t, f.Allocate(0, sz, 0))
+			st, err := f.fd.Stat()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(sz), st.Size())
+
+			o, err := f.TruncateAsync(sz / 2)
+			assert.NoError(t, err)
+			assert.NoError(t, o.Wait(time.Second))
+			_, err = o.Result()
+			assert.NoError(t, err)
+			st, err = f.fd.Stat()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(sz/2), st.Size())
+
+			if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+				assert.Equal(t, ErrNotSupported, f.Allocate(0, 4096, FallocPunchHole|FallocKeepSize))
+				return
+			}
+
+			buf := AllocBuf(4096)
+			for i := range buf {
+				buf[i] = 0xff
+			}
+			for _, mode := range []uint32{FallocPunchHole | FallocKeepSize, FallocZeroRange} {
+				o, err = f.WriteAtAsync(buf, 0)
+				assert.NoError(t, err)
+				assert.NoError(t, o.Wait(time.Second))
+				o, err = f.AllocateAsync(0, int64(len(buf)), mode)
+				assert.NoError(t, err)
+				assert.NoError(t, o.Wait(time.Second))
+				if _, err = o.Result(); err == syscall.EOPNOTSUPP {
+					// the filesystem can't do it
+					continue
+				}
+				assert.NoError(t, err)
+				out := AllocBuf(len(buf))
+				o, err = f.ReadAtAsync(out, 0)
+				assert.NoError(t, err)
+				assert.NoError(t, o.Wait(time.Second))
+				assert.Equal(t, make([]uint8, len(buf)), out)
+			}
+			st, err = f.fd.Stat()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(sz/2), st.Size())
+		}()
+	}
+}